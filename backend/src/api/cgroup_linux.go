@@ -0,0 +1,201 @@
+package api
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// rlimitNproc is RLIMIT_NPROC, which the syscall package does not define on Linux
+const rlimitNproc = 6
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cgroupParent is the cgroup v2 directory the backend creates execution cgroups in, set up on
+// first use. It is empty when cgroups are unavailable.
+var (
+	cgroupParentOnce sync.Once
+	cgroupParent     string
+	cgroupParentErr  error
+)
+
+// setupCgroupParent prepares the backend's own cgroup for execution sub-cgroups. cgroup v2 only
+// lets a cgroup hand controllers to its children when it has no processes of its own, so the
+// backend first moves itself into a "server" leaf next to where execution cgroups will go.
+// This needs a delegated (writable) cgroup, as systemd gives services with Delegate=yes and
+// containers with a private cgroup namespace, and only happens when PYSYNC_CGROUPS=on asks for
+// it. When a step fails, the backend goes back to the cgroup it came from.
+func setupCgroupParent() (string, error) {
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return "", errors.New("cgroup v2 is not mounted at " + cgroupRoot)
+	}
+	parent, err := ownCgroup()
+	if err != nil {
+		return "", err
+	}
+	if filepath.Base(parent) == "pysync-server" {
+		// Moved there by an earlier setup in this process
+		parent = filepath.Dir(parent)
+	}
+
+	controllers, err := os.ReadFile(filepath.Join(parent, "cgroup.controllers"))
+	if err != nil {
+		return "", err
+	}
+	for _, controller := range []string{"memory", "pids"} {
+		if !strings.Contains(" "+strings.TrimSpace(string(controllers))+" ", " "+controller+" ") {
+			return "", fmt.Errorf("the %s controller is not available in %s", controller, parent)
+		}
+	}
+
+	server := filepath.Join(parent, "pysync-server")
+	created := true
+	if err := os.Mkdir(server, 0755); os.IsExist(err) {
+		created = false
+	} else if err != nil {
+		return "", fmt.Errorf("cannot create cgroup: %w", err)
+	}
+	pid := []byte(strconv.Itoa(os.Getpid()))
+	if err := os.WriteFile(filepath.Join(server, "cgroup.procs"), pid, 0644); err != nil {
+		if created {
+			os.Remove(server)
+		}
+		return "", fmt.Errorf("cannot move the backend into %s: %w", server, err)
+	}
+	if err := os.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte("+memory +pids"), 0644); err != nil {
+		// Leave the backend where it was, e.g. when other processes in parent make it EBUSY
+		if moveErr := os.WriteFile(filepath.Join(parent, "cgroup.procs"), pid, 0644); moveErr != nil {
+			log.Printf("Cannot move the backend back into %s: %v", parent, moveErr)
+		} else if created {
+			os.Remove(server)
+		}
+		return "", fmt.Errorf("cannot enable controllers in %s: %w", parent, err)
+	}
+	return parent, nil
+}
+
+// ownCgroup returns the directory of the cgroup v2 the backend runs in
+func ownCgroup() (string, error) {
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			return filepath.Join(cgroupRoot, strings.TrimPrefix(line, "0::")), nil
+		}
+	}
+	return "", errors.New("the backend is not in a cgroup v2 hierarchy")
+}
+
+// cgroup is the cgroup one limited process runs in
+type cgroup struct {
+	path string
+	dir  *os.File
+}
+
+// cgroupEvents are the counters that show a cgroup limit was hit
+type cgroupEvents struct {
+	oomKills int64
+	pidsMax  int64
+}
+
+// newCgroup creates a cgroup that enforces the memory and process limits
+func newCgroup(limits ResourceLimits) (*cgroup, error) {
+	cgroupParentOnce.Do(func() {
+		cgroupParent, cgroupParentErr = setupCgroupParent()
+		if cgroupParentErr == nil {
+			log.Printf("Enforcing resource limits with cgroups under %s", cgroupParent)
+		} else {
+			log.Printf("Enforcing resource limits with rlimits only: %v", cgroupParentErr)
+		}
+	})
+	if cgroupParentErr != nil {
+		return nil, cgroupParentErr
+	}
+
+	path := filepath.Join(cgroupParent, "pysync-"+newMessageID())
+	if err := os.Mkdir(path, 0755); err != nil {
+		return nil, fmt.Errorf("cannot create cgroup: %w", err)
+	}
+	cg := &cgroup{path: path}
+	settings := map[string]uint64{"memory.max": limits.AddressSpace, "pids.max": limits.Processes}
+	for file, value := range settings {
+		if value == 0 {
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(path, file), []byte(strconv.FormatUint(value, 10)), 0644); err != nil {
+			cg.remove()
+			return nil, fmt.Errorf("cannot set %s: %w", file, err)
+		}
+	}
+	if limits.AddressSpace > 0 {
+		// Without swap limit the kernel would page out instead of enforcing memory.max
+		os.WriteFile(filepath.Join(path, "memory.swap.max"), []byte("0"), 0644)
+	}
+	dir, err := os.Open(path)
+	if err != nil {
+		cg.remove()
+		return nil, err
+	}
+	cg.dir = dir
+	return cg, nil
+}
+
+// attach makes cmd start directly inside the cgroup
+func (cg *cgroup) attach(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(cg.dir.Fd())
+}
+
+func (cg *cgroup) events() cgroupEvents {
+	return cgroupEvents{
+		oomKills: readCgroupCounter(filepath.Join(cg.path, "memory.events"), "oom_kill"),
+		pidsMax:  readCgroupCounter(filepath.Join(cg.path, "pids.events"), "max"),
+	}
+}
+
+func readCgroupCounter(file string, key string) int64 {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == key {
+			n, _ := strconv.ParseInt(fields[1], 10, 64)
+			return n
+		}
+	}
+	return 0
+}
+
+// remove kills anything left in the cgroup and deletes it
+func (cg *cgroup) remove() {
+	if cg.dir != nil {
+		cg.dir.Close()
+	}
+	os.WriteFile(filepath.Join(cg.path, "cgroup.kill"), []byte("1"), 0644)
+	// The kernel only lets an empty cgroup go, which takes a moment after the kill
+	for i := 0; i < 20; i++ {
+		if err := os.Remove(cg.path); err == nil || os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	log.Printf("Could not remove cgroup %s", cg.path)
+}
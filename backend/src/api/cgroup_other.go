@@ -0,0 +1,31 @@
+//go:build !linux
+
+package api
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// rlimitNproc is RLIMIT_NPROC, which the syscall package does not define on every platform
+const rlimitNproc = 7
+
+// cgroup is unused outside Linux; limits are enforced with rlimits only
+type cgroup struct{}
+
+type cgroupEvents struct {
+	oomKills int64
+	pidsMax  int64
+}
+
+func newCgroup(limits ResourceLimits) (*cgroup, error) {
+	return nil, errors.New("cgroups are only available on Linux")
+}
+
+func (cg *cgroup) attach(cmd *exec.Cmd) {}
+
+func (cg *cgroup) events() cgroupEvents {
+	return cgroupEvents{}
+}
+
+func (cg *cgroup) remove() {}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// Completion is the answer to a complete_request: the matches replace the code from
+// CursorStart to CursorEnd, character offsets like the request's cursor_pos
+type Completion struct {
+	Matches     []string `json:"matches"`
+	CursorStart int      `json:"cursor_start"`
+	CursorEnd   int      `json:"cursor_end"`
+}
+
+// Inspection is the answer to an inspect_request: what the object named at the cursor is
+type Inspection struct {
+	Found     bool   `json:"found"`
+	Name      string `json:"name,omitempty"`
+	Type      string `json:"type,omitempty"`
+	Signature string `json:"signature,omitempty"`
+	Docstring string `json:"docstring,omitempty"`
+	// Source is given at detail level 1 when the source is available
+	Source string `json:"source,omitempty"`
+	// Text is the description as the Jupyter kernel formats it; other fields are picked out of
+	// it for IPython kernels
+	Text string `json:"text,omitempty"`
+}
+
+// codeRequest is the content of a complete_request or inspect_request. CursorPos counts
+// characters (code points), not bytes.
+type codeRequest struct {
+	Code        string `json:"code"`
+	CursorPos   *int   `json:"cursor_pos"`
+	DetailLevel int    `json:"detail_level"`
+}
+
+// parseCodeRequest decodes the content of req; without a cursor_pos the cursor is at the end
+func parseCodeRequest(req WebSocketMessage) (codeRequest, error) {
+	var request codeRequest
+	if err := json.Unmarshal([]byte(req.Content), &request); err != nil {
+		return request, fmt.Errorf("invalid %s: %w", req.Type, err)
+	}
+	length := len([]rune(request.Code))
+	if request.CursorPos == nil {
+		request.CursorPos = &length
+	}
+	if *request.CursorPos < 0 || *request.CursorPos > length {
+		return request, fmt.Errorf("cursor_pos %d is outside the code", *request.CursorPos)
+	}
+	return request, nil
+}
+
+// complete answers a complete_request with a JSON Completion
+func (c *Client) complete(req WebSocketMessage) {
+	request, err := parseCodeRequest(req)
+	if err != nil {
+		c.sendDone(req, "complete_reply", "error", fmt.Sprintf("Error: %v", err))
+		return
+	}
+	kernel, ok := c.inspectableKernel(req, "complete_reply")
+	if !ok {
+		return
+	}
+	completion := &Completion{Matches: []string{}, CursorStart: *request.CursorPos, CursorEnd: *request.CursorPos}
+	if kernel != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), inspectTimeout)
+		defer cancel()
+		if completion, err = kernel.Complete(ctx, request.Code, *request.CursorPos); err != nil {
+			c.sendDone(req, "complete_reply", "error", fmt.Sprintf("Error: %v", err))
+			return
+		}
+	}
+	c.sendJSON(req, "complete_reply", completion)
+}
+
+// inspect answers an inspect_request with a JSON Inspection
+func (c *Client) inspect(req WebSocketMessage) {
+	request, err := parseCodeRequest(req)
+	if err != nil {
+		c.sendDone(req, "inspect_reply", "error", fmt.Sprintf("Error: %v", err))
+		return
+	}
+	kernel, ok := c.inspectableKernel(req, "inspect_reply")
+	if !ok {
+		return
+	}
+	inspection := &Inspection{}
+	if kernel != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), inspectTimeout)
+		defer cancel()
+		if inspection, err = kernel.Inspect(ctx, request.Code, *request.CursorPos, request.DetailLevel); err != nil {
+			c.sendDone(req, "inspect_reply", "error", fmt.Sprintf("Error: %v", err))
+			return
+		}
+	}
+	c.sendJSON(req, "inspect_reply", inspection)
+}
+
+// sendJSON replies with value encoded as the content of an "ok" message
+func (c *Client) sendJSON(req WebSocketMessage, replyType string, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		c.sendDone(req, replyType, "error", fmt.Sprintf("Error: %v", err))
+		return
+	}
+	c.sendDone(req, replyType, "ok", string(data))
+}
@@ -0,0 +1,185 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServerConfig holds the code socket settings read from PYSYNC_* environment variables when the
+// first session starts
+type ServerConfig struct {
+	// Kernel selects the kernel backend, see startKernel (PYSYNC_KERNEL)
+	Kernel string
+	// DefaultTimeout applies to executions that do not ask for a timeout; zero means no
+	// limit (PYSYNC_EXEC_TIMEOUT)
+	DefaultTimeout time.Duration
+	// MaxTimeout caps every execution, including ones that ask for no limit; zero means no
+	// cap (PYSYNC_MAX_EXEC_TIMEOUT)
+	MaxTimeout time.Duration
+	// Limits are the resource limits of every session's kernel and shell commands. Sessions
+	// may tighten them but not lift them (PYSYNC_LIMIT_MEMORY, PYSYNC_LIMIT_CPU_SECONDS,
+	// PYSYNC_LIMIT_OPEN_FILES, PYSYNC_LIMIT_PROCESSES)
+	Limits ResourceLimits
+	// UseCgroups enforces memory and process limits with cgroup v2 when the backend's cgroup
+	// is delegated to it (PYSYNC_CGROUPS=on); otherwise rlimits are used
+	UseCgroups bool
+	// Sandbox runs kernels and shell commands in Linux namespaces. Sessions may turn it on but
+	// not off (PYSYNC_SANDBOX=on, and PYSYNC_SANDBOX_NETWORK=on to keep the host network).
+	Sandbox SandboxOptions
+	// SandboxPaths are extra host paths sandboxed executions see read-only
+	// (PYSYNC_SANDBOX_PATHS, separated like PATH)
+	SandboxPaths []string
+	// OutputLimit caps the output of one execution sent inline, in bytes; the rest goes to a
+	// file the client can download. Zero means no cap (PYSYNC_OUTPUT_LIMIT, default 1M).
+	OutputLimit int64
+	// Workspace is the working directory of the kernels and shell commands of sessions that do
+	// not set their own; the server's working directory when empty (PYSYNC_WORKSPACE)
+	Workspace string
+	// Restart says when a kernel that died by itself is restarted right away. Sessions may set
+	// their own (PYSYNC_KERNEL_RESTART, default never, and PYSYNC_KERNEL_MAX_RESTARTS).
+	Restart RestartPolicy
+}
+
+const (
+	defaultExecTimeout = 30 * time.Second
+	defaultOutputLimit = 1 << 20
+)
+
+var (
+	serverConfigOnce sync.Once
+	serverConfig     ServerConfig
+)
+
+// getServerConfig returns the server configuration, loading it on first use
+func getServerConfig() ServerConfig {
+	serverConfigOnce.Do(func() {
+		serverConfig = ServerConfig{
+			Kernel:         os.Getenv("PYSYNC_KERNEL"),
+			DefaultTimeout: durationSetting("PYSYNC_EXEC_TIMEOUT", defaultExecTimeout),
+			MaxTimeout:     durationSetting("PYSYNC_MAX_EXEC_TIMEOUT", 0),
+			Limits:         limitsSetting(),
+			UseCgroups:     os.Getenv("PYSYNC_CGROUPS") == "on",
+			Sandbox:        sandboxSetting(),
+			SandboxPaths:   filepath.SplitList(os.Getenv("PYSYNC_SANDBOX_PATHS")),
+			OutputLimit:    sizeSetting("PYSYNC_OUTPUT_LIMIT", defaultOutputLimit),
+			Workspace:      os.Getenv("PYSYNC_WORKSPACE"),
+			Restart:        restartPolicySetting(),
+		}
+		log.Printf("Server config: %+v", serverConfig)
+	})
+	return serverConfig
+}
+
+// durationSetting reads a duration from the environment, either in Go syntax ("90s", "2h") or
+// as a number of seconds. "0", "none" and "unlimited" mean no limit. Invalid values are logged
+// and replaced by the fallback.
+func durationSetting(name string, fallback time.Duration) time.Duration {
+	value := strings.TrimSpace(os.Getenv(name))
+	if value == "" {
+		return fallback
+	}
+	d, err := parseDuration(value)
+	if err != nil {
+		log.Printf("Ignoring %s=%q: %v", name, value, err)
+		return fallback
+	}
+	return d
+}
+
+// sizeSetting reads a byte count from the environment, see parseSize. "0", "none" and
+// "unlimited" mean no limit. Invalid values are logged and replaced by the fallback.
+func sizeSetting(name string, fallback int64) int64 {
+	value := strings.TrimSpace(os.Getenv(name))
+	switch strings.ToLower(value) {
+	case "":
+		return fallback
+	case "none", "unlimited":
+		return 0
+	}
+	n, err := parseSize(value)
+	if err != nil {
+		log.Printf("Ignoring %s=%q: %v", name, value, err)
+		return fallback
+	}
+	return int64(n)
+}
+
+func parseDuration(value string) (time.Duration, error) {
+	switch strings.ToLower(value) {
+	case "none", "unlimited":
+		return 0, nil
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return secondsToDuration(seconds)
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("not a duration: %w", err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("negative duration %s", d)
+	}
+	return d, nil
+}
+
+// secondsToDuration converts a timeout in seconds, where zero means no limit. Negative, NaN and
+// infinite values are errors rather than no limit, so that a typo does not lift the limit.
+// Timeouts longer than a time.Duration holds, about 292 years, are cut to that.
+func secondsToDuration(seconds float64) (time.Duration, error) {
+	switch {
+	case math.IsNaN(seconds) || math.IsInf(seconds, 0):
+		return 0, fmt.Errorf("%v is not a number of seconds", seconds)
+	case seconds < 0:
+		return 0, fmt.Errorf("negative timeout %v", seconds)
+	}
+	nanoseconds := seconds * float64(time.Second)
+	if nanoseconds >= math.MaxInt64 {
+		return math.MaxInt64, nil
+	}
+	return time.Duration(nanoseconds), nil
+}
+
+// execLimit is the timeout an execution runs under and where it came from
+type execLimit struct {
+	timeout time.Duration
+	// source names the limit in timeout messages: "cell", "server default" or "server maximum"
+	source string
+}
+
+// resolveTimeout picks the timeout for a request: the request's own timeout if it set one,
+// otherwise the server default, in both cases capped by the server maximum. An invalid request
+// timeout is an error.
+func resolveTimeout(req WebSocketMessage, config ServerConfig) (execLimit, error) {
+	limit := execLimit{timeout: config.DefaultTimeout, source: "server default"}
+	if req.Timeout != nil {
+		timeout, err := secondsToDuration(*req.Timeout)
+		if err != nil {
+			return execLimit{}, fmt.Errorf("invalid timeout: %w", err)
+		}
+		limit = execLimit{timeout: timeout, source: "cell"}
+	}
+	if config.MaxTimeout > 0 && (limit.timeout == 0 || limit.timeout > config.MaxTimeout) {
+		limit = execLimit{timeout: config.MaxTimeout, source: "server maximum"}
+	}
+	return limit, nil
+}
+
+// context returns a context that expires with the limit, or never if there is none
+func (l execLimit) context() (context.Context, context.CancelFunc) {
+	if l.timeout == 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), l.timeout)
+}
+
+func (l execLimit) message() string {
+	return fmt.Sprintf("Execution timed out after %s (%s timeout)", l.timeout, l.source)
+}
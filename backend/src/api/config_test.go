@@ -0,0 +1,81 @@
+package api
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"90", 90 * time.Second, false},
+		{"1.5", 1500 * time.Millisecond, false},
+		{"0", 0, false},
+		{"-5", 0, true},
+		{"90s", 90 * time.Second, false},
+		{"2h30m", 150 * time.Minute, false},
+		{"-1m", 0, true},
+		{"none", 0, false},
+		{"Unlimited", 0, false},
+		{"1e300", math.MaxInt64, false},
+		{"NaN", 0, true},
+		{"Inf", 0, true},
+		{"-inf", 0, true},
+		{"soon", 0, true},
+		{"10 minutes", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseDuration(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveTimeout(t *testing.T) {
+	seconds := func(s float64) *float64 { return &s }
+	config := func(defaultTimeout, maxTimeout time.Duration) ServerConfig {
+		return ServerConfig{DefaultTimeout: defaultTimeout, MaxTimeout: maxTimeout}
+	}
+	tests := []struct {
+		name    string
+		timeout *float64
+		config  ServerConfig
+		want    execLimit
+		wantErr bool
+	}{
+		{"server default", nil, config(30*time.Second, 0), execLimit{30 * time.Second, "server default"}, false},
+		{"no default", nil, config(0, 0), execLimit{0, "server default"}, false},
+		{"cell timeout", seconds(5), config(30*time.Second, 0), execLimit{5 * time.Second, "cell"}, false},
+		{"cell asks for no limit", seconds(0), config(30*time.Second, 0), execLimit{0, "cell"}, false},
+		{"negative cell timeout", seconds(-1), config(30*time.Second, 0), execLimit{}, true},
+		{"negative with a maximum", seconds(-1), config(30*time.Second, time.Minute), execLimit{}, true},
+		{"NaN cell timeout", seconds(math.NaN()), config(30*time.Second, 0), execLimit{}, true},
+		{"within the maximum", seconds(5), config(30*time.Second, time.Minute), execLimit{5 * time.Second, "cell"}, false},
+		{"over the maximum", seconds(120), config(30*time.Second, time.Minute), execLimit{time.Minute, "server maximum"}, false},
+		{"no limit capped", seconds(0), config(30*time.Second, time.Minute), execLimit{time.Minute, "server maximum"}, false},
+		{"default over the maximum", nil, config(2*time.Minute, time.Minute), execLimit{time.Minute, "server maximum"}, false},
+		{"overflowing cell timeout", seconds(1e300), config(30*time.Second, 0), execLimit{math.MaxInt64, "cell"}, false},
+		{"overflow capped", seconds(1e300), config(30*time.Second, time.Minute), execLimit{time.Minute, "server maximum"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveTimeout(WebSocketMessage{Timeout: tt.timeout}, tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,310 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// The reasons a kernel_died message gives for the death of a kernel
+const (
+	// DeathOOM is a kernel the OOM killer took, for its cgroup's memory limit or the machine's
+	DeathOOM = "oom"
+	// DeathLimit is a kernel stopped by another of its resource limits, e.g. CPU time
+	DeathLimit = "limit"
+	// DeathSignal is a kernel that crashed (SIGSEGV, SIGABRT, ...) or was killed by a signal
+	// from outside the backend
+	DeathSignal = "signal"
+	// DeathExit is a kernel that exited by itself, e.g. with os._exit
+	DeathExit = "exit"
+)
+
+// KernelDeath explains why a kernel process exited
+type KernelDeath struct {
+	// Reason is one of the Death* constants
+	Reason string
+	// ExitCode is the exit status, or 128 plus the signal that killed the kernel
+	ExitCode int
+	// Signal names the signal that killed the kernel, e.g. "SIGSEGV"
+	Signal string
+	// Limit names the resource limit of a DeathOOM or DeathLimit, if a limit of the
+	// session's was the cause
+	Limit string
+	// Description says what happened, for people
+	Description string
+}
+
+// crashSignals are the signals a process gets for its own faults rather than from others
+var crashSignals = map[syscall.Signal]bool{
+	syscall.SIGSEGV: true,
+	syscall.SIGBUS:  true,
+	syscall.SIGILL:  true,
+	syscall.SIGFPE:  true,
+	syscall.SIGABRT: true,
+	syscall.SIGSYS:  true,
+	syscall.SIGTRAP: true,
+}
+
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGABRT: "SIGABRT",
+	syscall.SIGBUS:  "SIGBUS",
+	syscall.SIGFPE:  "SIGFPE",
+	syscall.SIGHUP:  "SIGHUP",
+	syscall.SIGILL:  "SIGILL",
+	syscall.SIGINT:  "SIGINT",
+	syscall.SIGKILL: "SIGKILL",
+	syscall.SIGPIPE: "SIGPIPE",
+	syscall.SIGQUIT: "SIGQUIT",
+	syscall.SIGSEGV: "SIGSEGV",
+	syscall.SIGSYS:  "SIGSYS",
+	syscall.SIGTERM: "SIGTERM",
+	syscall.SIGTRAP: "SIGTRAP",
+	syscall.SIGUSR1: "SIGUSR1",
+	syscall.SIGUSR2: "SIGUSR2",
+	syscall.SIGXCPU: "SIGXCPU",
+	syscall.SIGXFSZ: "SIGXFSZ",
+}
+
+func signalName(sig syscall.Signal) string {
+	if name, ok := signalNames[sig]; ok {
+		return name
+	}
+	return "signal " + strconv.Itoa(int(sig))
+}
+
+// exitDiagnosis works out why a kernel process exited, once, so that the cell that was running
+// and the kernel_died message tell the same story
+type exitDiagnosis struct {
+	// ooms is the OOM kill count of the backend's cgroup from before the process started
+	ooms  int64
+	once  sync.Once
+	death *KernelDeath
+}
+
+// newExitDiagnosis must be called before the process it will explain is started
+func newExitDiagnosis() *exitDiagnosis {
+	return &exitDiagnosis{ooms: cgroupOOMKills()}
+}
+
+// explain diagnoses the exit of a process that has been waited for and ran under limits
+func (d *exitDiagnosis) explain(state *os.ProcessState, limits *processLimits) *KernelDeath {
+	d.once.Do(func() {
+		d.death = d.diagnose(state, limits)
+		log.Printf("Kernel death: %s", d.death.Description)
+	})
+	return d.death
+}
+
+// diagnose tells the OOM killer from other deaths by the SIGKILL it sends and the evidence it
+// leaves: the OOM kill counters of the kernel's cgroup and the backend's, and its record in the
+// kernel log
+func (d *exitDiagnosis) diagnose(state *os.ProcessState, limits *processLimits) *KernelDeath {
+	if state == nil {
+		return &KernelDeath{Reason: DeathExit, Description: "The kernel exited"}
+	}
+	death := &KernelDeath{Reason: DeathExit, ExitCode: state.ExitCode()}
+	var sig syscall.Signal
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		sig = status.Signal()
+		death.ExitCode = 128 + int(sig)
+		death.Signal = signalName(sig)
+	}
+
+	var configured ResourceLimits
+	if limits != nil {
+		configured = limits.limits
+	}
+	var oomRecord string
+	if sig == syscall.SIGKILL {
+		oomRecord = kernelLogOOMKill(state.Pid())
+	}
+	switch limit := limits.exceeded(state); {
+	case limit == "address_space":
+		death.Reason, death.Limit = DeathOOM, limit
+		death.Description = fmt.Sprintf("The kernel ran out of memory and was killed for exceeding its %s", configured.describe(limit))
+	case limit != "":
+		death.Reason, death.Limit = DeathLimit, limit
+		death.Description = fmt.Sprintf("The kernel was stopped by its %s", configured.describe(limit))
+	case oomRecord != "":
+		log.Printf("Kernel log: %s", oomRecord)
+		death.Reason = DeathOOM
+		death.Description = "The kernel ran out of memory and was killed by the system's OOM killer"
+	case sig == syscall.SIGKILL && cgroupOOMKills() > d.ooms:
+		death.Reason = DeathOOM
+		death.Description = "The kernel ran out of memory and was killed by the OOM killer of the server's cgroup"
+	case crashSignals[sig]:
+		death.Reason = DeathSignal
+		death.Description = fmt.Sprintf("The kernel crashed with %s (%v)", death.Signal, sig)
+	case sig != 0:
+		death.Reason = DeathSignal
+		death.Description = fmt.Sprintf("The kernel was killed by %s (%v)", death.Signal, sig)
+	default:
+		death.Description = fmt.Sprintf("The kernel exited with status %d", death.ExitCode)
+	}
+	return death
+}
+
+// The values of RestartPolicy.When
+const (
+	RestartNever     = "never"
+	RestartOnFailure = "on-failure"
+	RestartAlways    = "always"
+)
+
+// defaultMaxRestarts caps automatic restarts unless PYSYNC_KERNEL_MAX_RESTARTS says otherwise
+const defaultMaxRestarts = 3
+
+// RestartPolicy says when a session kernel that died by itself is replaced right away, rather
+// than when the next cell needs one
+type RestartPolicy struct {
+	// When is "never", "on-failure" (unless it exited with status 0) or "always"
+	When string `json:"when"`
+	// MaxRestarts caps the automatic restarts in a row, counted until a cell runs to the end;
+	// zero means no cap
+	MaxRestarts int `json:"max_restarts"`
+}
+
+func (p RestartPolicy) validate() error {
+	switch p.When {
+	case RestartNever, RestartOnFailure, RestartAlways:
+	default:
+		return fmt.Errorf("unknown restart policy %q; use %q, %q or %q", p.When, RestartNever, RestartOnFailure, RestartAlways)
+	}
+	if p.MaxRestarts < 0 {
+		return fmt.Errorf("max_restarts must not be negative")
+	}
+	return nil
+}
+
+// restarts reports whether the policy restarts a kernel that died of death
+func (p RestartPolicy) restarts(death *KernelDeath) bool {
+	switch p.When {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		return death.Reason != DeathExit || death.ExitCode != 0
+	}
+	return false
+}
+
+// restartPolicySetting reads the server's restart policy from the environment. Invalid values
+// are logged and ignored.
+func restartPolicySetting() RestartPolicy {
+	policy := RestartPolicy{When: RestartNever, MaxRestarts: defaultMaxRestarts}
+	if value := strings.ToLower(strings.TrimSpace(os.Getenv("PYSYNC_KERNEL_RESTART"))); value != "" {
+		if err := (RestartPolicy{When: value}).validate(); err != nil {
+			log.Printf("Ignoring PYSYNC_KERNEL_RESTART=%q: %v", value, err)
+		} else {
+			policy.When = value
+		}
+	}
+	if value := strings.TrimSpace(os.Getenv("PYSYNC_KERNEL_MAX_RESTARTS")); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			log.Printf("Ignoring PYSYNC_KERNEL_MAX_RESTARTS=%q: not a count", value)
+		} else {
+			policy.MaxRestarts = n
+		}
+	}
+	return policy
+}
+
+// restartPolicyLocked returns the policy the session set, or else the server's
+func (c *Client) restartPolicyLocked() RestartPolicy {
+	if c.restartPolicy != nil {
+		return *c.restartPolicy
+	}
+	return getServerConfig().Restart
+}
+
+// setRestartPolicy handles a set_restart_policy request, whose content is a JSON RestartPolicy.
+// Fields left out keep their current value. The reply carries the policy in effect.
+func (c *Client) setRestartPolicy(req WebSocketMessage) {
+	c.kernelMu.Lock()
+	policy := c.restartPolicyLocked()
+	err := json.Unmarshal([]byte(req.Content), &policy)
+	if err == nil {
+		err = policy.validate()
+	}
+	if err == nil {
+		c.restartPolicy = &policy
+	}
+	c.kernelMu.Unlock()
+	if err != nil {
+		c.sendDone(req, "restart_policy", "error", fmt.Sprintf("Error: invalid restart policy: %v", err))
+		return
+	}
+	c.sendJSON(req, "restart_policy", policy)
+}
+
+// kernelExitedLocked reports the exit of the session kernel and lets it go. An exit the backend
+// did not cause is explained in a kernel_died message. It returns nil when kernel is no longer
+// the session's, as its exit has been reported already, or when its exit was expected.
+func (c *Client) kernelExitedLocked(kernel Kernel) *KernelDeath {
+	if c.kernel != kernel {
+		return nil
+	}
+	c.kernel = nil
+	kernel.Close()
+	if c.stoppedKernel == kernel {
+		c.stoppedKernel = nil
+		c.setKernelStatus(KernelDead, "The kernel was stopped")
+		return nil
+	}
+	death := kernel.Death()
+	c.setKernelStatus(KernelDead, death.Description)
+	exitCode := death.ExitCode
+	c.sendMessage(WebSocketMessage{
+		Type:     "kernel_died",
+		Status:   death.Reason,
+		Content:  death.Description,
+		ExitCode: &exitCode,
+		Signal:   death.Signal,
+		Limit:    death.Limit,
+	})
+	return death
+}
+
+// stopKernelLocked records that the backend is about to kill the session kernel, so that its
+// death is not taken for a crash
+func (c *Client) stopKernelLocked(kernel Kernel) {
+	if c.kernel == kernel {
+		c.stoppedKernel = kernel
+	}
+}
+
+// stopKernel is stopKernelLocked for callers that do not hold kernelMu
+func (c *Client) stopKernel(kernel Kernel) {
+	c.kernelMu.Lock()
+	defer c.kernelMu.Unlock()
+	c.stopKernelLocked(kernel)
+}
+
+// restartAfterDeathLocked starts a new kernel in place of one that died of death if the
+// session's restart policy says so
+func (c *Client) restartAfterDeathLocked(death *KernelDeath) {
+	policy := c.restartPolicyLocked()
+	if !policy.restarts(death) {
+		return
+	}
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	if policy.MaxRestarts > 0 && c.autoRestarts >= policy.MaxRestarts {
+		log.Printf("Not restarting the kernel after %d automatic restarts in a row", c.autoRestarts)
+		return
+	}
+	c.autoRestarts++
+	log.Printf("Restarting the kernel (%d in a row)", c.autoRestarts)
+	c.setKernelStatus(KernelRestarting, death.Description)
+	if _, err := c.startKernelLocked(); err != nil {
+		log.Printf("Error restarting kernel: %v", err)
+	}
+}
@@ -0,0 +1,375 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// debugTimeout bounds how long starting debugpy in the kernel and connecting to it may take
+const debugTimeout = 15 * time.Second
+
+// debugSessions maps the tokens of debug socket URLs to the debuggers they connect to
+var (
+	debugSessionsMu sync.Mutex
+	debugSessions   = make(map[string]*debugSession)
+)
+
+// debugSession is the debugger of one code socket session
+type debugSession struct {
+	client *Client
+	// address is the unix socket the debug adapter of the session's kernel listens on, in
+	// cellDir
+	address string
+	cellDir string
+}
+
+// Debugger is the reply to a start_debugger request
+type Debugger struct {
+	// URL is the WebSocket endpoint, relative to the server, that speaks the Debug Adapter
+	// Protocol with the kernel
+	URL string `json:"url"`
+	// CellDir holds the files cells are run from while debugging
+	CellDir string `json:"cell_dir"`
+}
+
+// startDebugger attaches debugpy to the session kernel, starting a kernel if there is none, and
+// replies with the URL of the debug socket
+func (c *Client) startDebugger(req WebSocketMessage) {
+	if c.kernelBusy() {
+		c.sendDone(req, "debugger", "busy", "The kernel is running a cell")
+		return
+	}
+	kernel, err := c.getKernel()
+	if err != nil {
+		c.sendDone(req, "debugger", "error", fmt.Sprintf("Error: %v", err))
+		return
+	}
+	cellDir, err := c.debugCellDir()
+	if err != nil {
+		c.sendDone(req, "debugger", "error", fmt.Sprintf("Error: %v", err))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), debugTimeout)
+	defer cancel()
+	address, err := kernel.Debug(ctx, cellDir)
+	if err != nil {
+		c.sendDone(req, "debugger", "error", fmt.Sprintf("Error: %v", err))
+		return
+	}
+
+	c.debugMu.Lock()
+	defer c.debugMu.Unlock()
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	debugSessionsMu.Lock()
+	session, ok := debugSessions[c.debugToken]
+	if !ok {
+		c.debugToken = newMessageID()
+		session = &debugSession{client: c}
+		debugSessions[c.debugToken] = session
+	}
+	session.address = address
+	session.cellDir = cellDir
+	debugSessionsMu.Unlock()
+	c.sendJSON(req, "debugger", Debugger{URL: "/ws/debugSocket/" + c.debugToken, CellDir: cellDir})
+}
+
+// debugCellDir returns the directory for the session's cell files and debug socket, creating it
+// on first use next to the output directory: hidden in the workspace or else in the system temp
+// directory, which a sandboxed kernel cannot see
+func (c *Client) debugCellDir() (string, error) {
+	workspace := c.workspace()
+	sandboxed := c.processOptions().Sandbox.Enabled
+	c.debugMu.Lock()
+	defer c.debugMu.Unlock()
+	select {
+	case <-c.done:
+		return "", errSessionClosed
+	default:
+	}
+	if c.debugDir == "" {
+		dir, err := os.MkdirTemp(workspace, ".pysync_debug_")
+		if err != nil && sandboxed {
+			return "", fmt.Errorf("cannot create the debugger directory in the workspace: %w", err)
+		}
+		if err != nil {
+			log.Printf("Cannot keep debugger cells in the workspace: %v", err)
+			if dir, err = os.MkdirTemp("", "pysync_debug_"); err != nil {
+				return "", err
+			}
+		}
+		c.debugDir = dir
+	}
+	return c.debugDir, nil
+}
+
+// removeDebugger withdraws the session's debug socket and deletes its cell files. Open debug
+// sockets close when the kernel, and with it the debug adapter, goes away.
+func (c *Client) removeDebugger() {
+	c.debugMu.Lock()
+	defer c.debugMu.Unlock()
+
+	debugSessionsMu.Lock()
+	delete(debugSessions, c.debugToken)
+	debugSessionsMu.Unlock()
+	c.debugToken = ""
+
+	if c.debugDir != "" {
+		if err := os.RemoveAll(c.debugDir); err != nil {
+			log.Printf("Error removing debugger directory: %v", err)
+		}
+		c.debugDir = ""
+	}
+}
+
+// debugCellFile names the file a cell with the given code runs from while debugging. kernel.py
+// derives the same name.
+func debugCellFile(cellDir, code string) string {
+	sum := sha1.Sum([]byte(code))
+	return filepath.Join(cellDir, "cell_"+hex.EncodeToString(sum[:])[:16]+".py")
+}
+
+// dapMessage holds the fields of a Debug Adapter Protocol message the bridge looks at
+type dapMessage struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// DebugHandler serves the debug socket of a session, at the URL given in its debugger reply.
+// Every WebSocket text message is one Debug Adapter Protocol message, without the
+// Content-Length header the adapter frames them with.
+func DebugHandler(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, "/ws/debugSocket/")
+	debugSessionsMu.Lock()
+	session, ok := debugSessions[token]
+	var address, cellDir string
+	if ok {
+		address, cellDir = session.address, session.cellDir
+	}
+	debugSessionsMu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	err := checkDebugSocket(address)
+	var adapter net.Conn
+	if err == nil {
+		adapter, err = net.DialTimeout("unix", address, debugTimeout)
+	}
+	if err != nil {
+		log.Printf("Error connecting to debug adapter: %v", err)
+		http.Error(w, "The debugger is not running; send start_debugger again", http.StatusBadGateway)
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		adapter.Close()
+		return
+	}
+
+	bridge := &debugBridge{conn: conn, adapter: adapter, cellDir: cellDir, send: make(chan []byte, 256), done: make(chan struct{})}
+	go bridge.writePump()
+	go bridge.readAdapter()
+	go func() {
+		// The bridge ends with the session that started the debugger
+		select {
+		case <-session.client.done:
+			bridge.close()
+		case <-bridge.done:
+		}
+	}()
+	bridge.readPump()
+}
+
+// checkDebugSocket makes sure that the debug adapter's socket at path is a socket of the
+// server's user that no one else can connect to, as the adapter does not authenticate clients
+func checkDebugSocket(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Type() != os.ModeSocket {
+		return fmt.Errorf("%s is not a socket", path)
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Getuid() {
+		return fmt.Errorf("%s belongs to uid %d", path, stat.Uid)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("%s is open to other users (mode %v)", path, info.Mode().Perm())
+	}
+	return nil
+}
+
+// debugBridge proxies one debug socket to the debug adapter of a kernel
+type debugBridge struct {
+	conn    *websocket.Conn
+	adapter net.Conn
+	cellDir string
+	send    chan []byte
+	done    chan struct{}
+	once    sync.Once
+}
+
+func (b *debugBridge) close() {
+	b.once.Do(func() {
+		close(b.done)
+		b.adapter.Close()
+		b.conn.Close()
+	})
+}
+
+// readPump passes the client's messages to the adapter, answering dumpCell requests itself
+func (b *debugBridge) readPump() {
+	defer b.close()
+	b.conn.SetReadLimit(maxMessageSize)
+	b.conn.SetReadDeadline(time.Now().Add(pongWait))
+	b.conn.SetPongHandler(func(string) error {
+		b.conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	for {
+		_, message, err := b.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				log.Printf("Error: %v", err)
+			}
+			return
+		}
+		var msg dapMessage
+		if err := json.Unmarshal(message, &msg); err != nil {
+			log.Printf("Dropping invalid debug message: %v", err)
+			continue
+		}
+		if msg.Type == "request" && msg.Command == "dumpCell" {
+			b.dumpCell(msg)
+			continue
+		}
+		if _, err := fmt.Fprintf(b.adapter, "Content-Length: %d\r\n\r\n%s", len(message), message); err != nil {
+			log.Printf("Error writing to debug adapter: %v", err)
+			return
+		}
+	}
+}
+
+// dumpCell saves the code of a cell to the file it will run from and answers with its path, so
+// that breakpoints can be set in a cell before it runs. The request and its response are
+// those of ipykernel's debugger.
+func (b *debugBridge) dumpCell(req dapMessage) {
+	var args struct {
+		Code string `json:"code"`
+	}
+	response := map[string]interface{}{"seq": 0, "type": "response", "request_seq": req.Seq, "command": req.Command}
+	err := json.Unmarshal(req.Arguments, &args)
+	path := debugCellFile(b.cellDir, args.Code)
+	if err == nil {
+		err = os.WriteFile(path, []byte(args.Code), 0644)
+	}
+	if err != nil {
+		response["success"] = false
+		response["message"] = err.Error()
+	} else {
+		response["success"] = true
+		response["body"] = map[string]string{"sourcePath": path}
+	}
+	data, _ := json.Marshal(response)
+	b.queue(data)
+}
+
+// readAdapter passes the adapter's messages to the client, one WebSocket message each
+func (b *debugBridge) readAdapter() {
+	defer b.close()
+	reader := bufio.NewReader(b.adapter)
+	for {
+		message, err := readDAPMessage(reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("Error reading from debug adapter: %v", err)
+			}
+			return
+		}
+		if !b.queue(message) {
+			return
+		}
+	}
+}
+
+// readDAPMessage reads one Content-Length framed message
+func readDAPMessage(reader *bufio.Reader) ([]byte, error) {
+	header, err := textproto.NewReader(reader).ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil || length < 0 {
+		return nil, fmt.Errorf("invalid Content-Length %q", header.Get("Content-Length"))
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(reader, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// queue hands a message to writePump, reporting false once the bridge is closed
+func (b *debugBridge) queue(message []byte) bool {
+	select {
+	case b.send <- message:
+		return true
+	case <-b.done:
+		return false
+	}
+}
+
+// writePump is the debug socket's only writer, like Client.writePump
+func (b *debugBridge) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		b.close()
+	}()
+
+	for {
+		select {
+		case message := <-b.send:
+			b.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := b.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
+		case <-ticker.C:
+			b.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := b.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-b.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// listenDebugSocket listens on a unix socket at path with the given mode, as debugpy's adapter
+// does in the kernel
+func listenDebugSocket(t *testing.T, path string, mode os.FileMode) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	if err := os.Chmod(path, mode); err != nil {
+		t.Fatal(err)
+	}
+	return listener
+}
+
+func TestCheckDebugSocket(t *testing.T) {
+	dir := t.TempDir()
+	listenDebugSocket(t, filepath.Join(dir, "private.sock"), 0600)
+	listenDebugSocket(t, filepath.Join(dir, "shared.sock"), 0666)
+	if err := os.WriteFile(filepath.Join(dir, "file"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{"private.sock", false},
+		{"shared.sock", true},
+		{"file", true},
+		{"missing.sock", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkDebugSocket(filepath.Join(dir, tt.name)); (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDebugBridge(t *testing.T) {
+	cellDir := t.TempDir()
+	address := filepath.Join(cellDir, "debugpy.sock")
+	listener := listenDebugSocket(t, address, 0600)
+
+	// The adapter answers every request with a response of the same command
+	adapterErr := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			adapterErr <- err
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for {
+			message, err := readDAPMessage(reader)
+			if err != nil {
+				adapterErr <- nil
+				return
+			}
+			var req dapMessage
+			if err := json.Unmarshal(message, &req); err != nil {
+				adapterErr <- err
+				return
+			}
+			response := fmt.Sprintf(`{"seq":1,"type":"response","request_seq":%d,"command":%q,"success":true}`, req.Seq, req.Command)
+			fmt.Fprintf(conn, "Content-Length: %d\r\n\r\n%s", len(response), response)
+		}
+	}()
+
+	client := &Client{send: make(chan []byte, 16), done: make(chan struct{})}
+	defer close(client.done)
+	debugSessionsMu.Lock()
+	debugSessions["test"] = &debugSession{client: client, address: address, cellDir: cellDir}
+	debugSessionsMu.Unlock()
+	defer func() {
+		debugSessionsMu.Lock()
+		delete(debugSessions, "test")
+		debugSessionsMu.Unlock()
+	}()
+
+	server := httptest.NewServer(http.HandlerFunc(DebugHandler))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws/debugSocket/"
+	if _, response, err := websocket.DefaultDialer.Dial(url+"unknown", nil); err == nil || response == nil || response.StatusCode != http.StatusNotFound {
+		t.Errorf("got %v for an unknown token, want 404", err)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(url+"test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	roundTrip := func(request string) map[string]interface{} {
+		t.Helper()
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(request)); err != nil {
+			t.Fatal(err)
+		}
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var response map[string]interface{}
+		if err := json.Unmarshal(message, &response); err != nil {
+			t.Fatalf("got %s: %v", message, err)
+		}
+		return response
+	}
+
+	// Requests reach the adapter and its responses come back, one WebSocket message each
+	response := roundTrip(`{"seq":1,"type":"request","command":"initialize","arguments":{"adapterID":"pysync"}}`)
+	if response["command"] != "initialize" || response["request_seq"] != 1.0 || response["success"] != true {
+		t.Errorf("got %v, want the adapter's initialize response", response)
+	}
+
+	// dumpCell is answered by the bridge
+	code := "x = 1\nprint(x)\n"
+	response = roundTrip(`{"seq":2,"type":"request","command":"dumpCell","arguments":{"code":"x = 1\nprint(x)\n"}}`)
+	path := debugCellFile(cellDir, code)
+	body, _ := response["body"].(map[string]interface{})
+	if response["success"] != true || response["request_seq"] != 2.0 || body["sourcePath"] != path {
+		t.Errorf("got %v, want a dumpCell response with sourcePath %s", response, path)
+	}
+	if saved, err := os.ReadFile(path); err != nil || string(saved) != code {
+		t.Errorf("got cell file %q, %v; want %q", saved, err, code)
+	}
+
+	conn.Close()
+	select {
+	case err := <-adapterErr:
+		if err != nil {
+			t.Errorf("adapter: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the bridge did not close its adapter connection")
+	}
+}
@@ -0,0 +1,165 @@
+package api
+
+import (
+	"log"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// execution is a running python, shell or pip request that can be signalled
+type execution struct {
+	req  WebSocketMessage
+	kind string
+	// deliver passes a signal on to the kernel or process group running the request
+	deliver func(sig syscall.Signal) error
+
+	mu          sync.Mutex
+	interrupted bool
+	killed      bool
+}
+
+// signal records that the execution was stopped from the client and delivers sig
+func (e *execution) signal(sig syscall.Signal) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	switch sig {
+	case syscall.SIGINT:
+		e.interrupted = true
+	case syscall.SIGKILL:
+		e.killed = true
+	}
+	return e.deliver(sig)
+}
+
+// outcome returns the status to report when the execution was stopped from the client, or ""
+func (e *execution) outcome() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	switch {
+	case e.killed:
+		return "killed"
+	case e.interrupted:
+		return "interrupted"
+	}
+	return ""
+}
+
+// signalProcessGroup returns a deliver function for a process started with Setpgid
+func signalProcessGroup(pgid int) func(sig syscall.Signal) error {
+	return func(sig syscall.Signal) error {
+		return syscall.Kill(-pgid, sig)
+	}
+}
+
+func (c *Client) trackExecution(e *execution) {
+	c.runningMu.Lock()
+	defer c.runningMu.Unlock()
+
+	if c.running == nil {
+		c.running = make(map[*execution]struct{})
+	}
+	c.running[e] = struct{}{}
+}
+
+func (c *Client) untrackExecution(e *execution) {
+	c.runningMu.Lock()
+	defer c.runningMu.Unlock()
+
+	delete(c.running, e)
+}
+
+// signalExecutions handles the interrupt and kill messages: SIGINT asks running code to stop
+// (a KeyboardInterrupt in Python cells), SIGKILL takes the process group down unconditionally.
+// A request with a parent_id only targets the execution started by that message.
+func (c *Client) signalExecutions(req WebSocketMessage, sig syscall.Signal) {
+	c.runningMu.Lock()
+	running := make([]*execution, 0, len(c.running))
+	for e := range c.running {
+		if req.ParentID == "" || req.ParentID == e.req.MsgID {
+			running = append(running, e)
+		}
+	}
+	c.runningMu.Unlock()
+
+	status := "interrupted"
+	if sig == syscall.SIGKILL {
+		status = "killed"
+	}
+	if len(running) == 0 {
+		c.reply(req, WebSocketMessage{Type: "interrupt_reply", Status: "not_running", Content: "Nothing is running"})
+		return
+	}
+
+	for _, e := range running {
+		if err := e.signal(sig); err != nil {
+			log.Printf("Error sending %v to %s execution %s: %v", sig, e.kind, e.req.MsgID, err)
+			c.reply(req, WebSocketMessage{Type: "interrupt_reply", Status: "error", CellID: e.req.CellID, Content: err.Error()})
+			continue
+		}
+		log.Printf("Sent %v to %s execution %s", sig, e.kind, e.req.MsgID)
+		c.reply(req, WebSocketMessage{Type: "interrupt_reply", Status: status, CellID: e.req.CellID, Content: e.kind})
+	}
+}
+
+// ProcessOptions is how a session confines the kernels and commands it starts
+type ProcessOptions struct {
+	Limits  ResourceLimits
+	Sandbox SandboxOptions
+	// Workdir is the session's workspace, which kernels and commands run in
+	Workdir string
+}
+
+// confine prepares cmd, which must not have been started, to run in the sandbox and under the
+// limits of options, with the writable paths mounted read-write in the sandbox. The returned
+// processLimits must be released once the process has exited.
+func confine(cmd *exec.Cmd, options ProcessOptions, writable ...string) (*processLimits, error) {
+	if err := sandboxProcess(cmd, options.Sandbox, writable...); err != nil {
+		return nil, err
+	}
+	return limitProcess(cmd, options.Limits)
+}
+
+// processOptions returns how the session's next kernel or command is confined
+func (c *Client) processOptions() ProcessOptions {
+	c.kernelMu.Lock()
+	defer c.kernelMu.Unlock()
+	return c.processOptionsLocked()
+}
+
+func (c *Client) processOptionsLocked() ProcessOptions {
+	return ProcessOptions{
+		Limits:  c.limits.within(getServerConfig().Limits),
+		Sandbox: c.sandboxOptionsLocked(),
+		Workdir: c.workspaceLocked(),
+	}
+}
+
+// runProcess runs cmd in its own process group, tracked so that interrupt and kill messages
+// reach it, and waits for it to exit. cmd should come from exec.CommandContext; cancelling the
+// context kills the whole group.
+func (c *Client) runProcess(req WebSocketMessage, kind string, cmd *exec.Cmd) (*execution, error) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	// Take down anything the command started along with it
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = time.Second
+
+	run := &execution{req: req, kind: kind}
+	if err := cmd.Start(); err != nil {
+		log.Printf("Error starting %s process: %v", kind, err)
+		return run, err
+	}
+	run.deliver = signalProcessGroup(cmd.Process.Pid)
+	c.trackExecution(run)
+	defer c.untrackExecution(run)
+
+	return run, cmd.Wait()
+}
@@ -0,0 +1,178 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"sort"
+	"sync"
+	"syscall"
+)
+
+// Executor runs the requests of the message types it is registered for. Every session queues
+// those requests and hands them to Execute one at a time; interrupt, kill and cancel messages
+// apply to them all.
+type Executor interface {
+	// DoneType is the message type that ends a request, such as "python_done". A request
+	// cancelled while queued gets one with status "cancelled".
+	DoneType() string
+	// Execute runs req for the session c and must end it with a DoneType message. Anything it
+	// runs should be tracked (runProcess does) so that interrupt and kill reach it.
+	Execute(c *Client, req WebSocketMessage)
+}
+
+// executors maps message types to the executors that run them
+var (
+	executorsMu sync.RWMutex
+	executors   = make(map[string]Executor)
+)
+
+// RegisterExecutor makes executor run the requests of type msgType, in place of any executor
+// registered for it before. The control messages of the code socket, such as interrupt or
+// env_info, cannot be taken over.
+func RegisterExecutor(msgType string, executor Executor) {
+	executorsMu.Lock()
+	defer executorsMu.Unlock()
+	executors[msgType] = executor
+}
+
+func lookupExecutor(msgType string) (Executor, bool) {
+	executorsMu.RLock()
+	defer executorsMu.RUnlock()
+	executor, ok := executors[msgType]
+	return executor, ok
+}
+
+// executorTypes lists the message types that have an executor, sorted
+func executorTypes() []string {
+	executorsMu.RLock()
+	defer executorsMu.RUnlock()
+	types := make([]string, 0, len(executors))
+	for msgType := range executors {
+		types = append(types, msgType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// clientExecutor adapts a Client method to Executor
+type clientExecutor struct {
+	doneType string
+	run      func(c *Client, req WebSocketMessage)
+}
+
+func (e clientExecutor) DoneType() string { return e.doneType }
+
+func (e clientExecutor) Execute(c *Client, req WebSocketMessage) { e.run(c, req) }
+
+// CommandExecutor runs the content of a request as a program: the request's code is appended
+// to Command, as in "sh -c <code>". Output streams as <Language>_stream messages and
+// <Language>_done ends the request, with the exit code. The session's timeout, resource limits,
+// sandbox and workspace apply.
+type CommandExecutor struct {
+	Language string
+	Command  []string
+}
+
+func (e *CommandExecutor) DoneType() string {
+	return e.Language + "_done"
+}
+
+func (e *CommandExecutor) Execute(c *Client, req WebSocketMessage) {
+	doneType := e.DoneType()
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Recovered from panic in %s executor: %v", e.Language, r)
+			c.sendDone(req, doneType, "error", fmt.Sprintf("Error: %v", r))
+		}
+	}()
+
+	log.Printf("Executing %s command: %s", e.Language, req.Content)
+	limit, err := resolveTimeout(req, getServerConfig())
+	if err != nil {
+		c.sendDone(req, doneType, "error", fmt.Sprintf("Error: %v", err))
+		return
+	}
+	ctx, cancel := limit.context()
+	defer cancel()
+
+	stream := newOutputStream(c, req, e.Language+"_stream")
+	options := c.processOptions()
+	args := append(append([]string{}, e.Command[1:]...), req.Content)
+	cmd := exec.CommandContext(ctx, e.Command[0], args...)
+	cmd.Dir = options.Workdir
+	cmd.Stdout = stream.Writer("stdout")
+	cmd.Stderr = stream.Writer("stderr")
+	limited, err := confine(cmd, options)
+	if err == nil && options.Sandbox.Enabled {
+		// Without an init, the command would be the first process of the sandbox's PID
+		// namespace, which ignores the interrupt
+		err = viaLauncher(cmd, "-init")
+	}
+	if err != nil {
+		limited.release()
+		c.sendDone(req, doneType, "error", fmt.Sprintf("Error: %v", err))
+		return
+	}
+	defer limited.release()
+
+	run, err := c.runProcess(req, e.Language, cmd)
+	stream.Close()
+	c.recordProcessUsage(req, cmd.ProcessState)
+	var exceeded string
+	if err != nil {
+		exceeded = limited.exceeded(cmd.ProcessState)
+	}
+
+	done := WebSocketMessage{Type: doneType, Status: "ok"}
+	var signal syscall.Signal
+	if cmd.ProcessState != nil {
+		exitCode := cmd.ProcessState.ExitCode()
+		if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			signal = status.Signal()
+			exitCode = 128 + int(signal)
+		}
+		done.ExitCode = &exitCode
+	}
+	var exitErr *exec.ExitError
+	switch outcome := run.outcome(); {
+	case outcome != "" && err != nil:
+		done.Status, done.Content = outcome, fmt.Sprintf("Error: %v", err)
+	case exceeded != "":
+		c.sendLimitExceeded(req, doneType, exceeded, "")
+		return
+	case ctx.Err() == context.DeadlineExceeded:
+		done.Status, done.Content = "timeout", limit.message()
+	case signal != 0:
+		done.Status, done.Content = "error", fmt.Sprintf("Command was killed: %v", signal)
+	case errors.As(err, &exitErr):
+		done.Status, done.Content = "error", fmt.Sprintf("Command exited with code %d", exitErr.ExitCode())
+	case err != nil:
+		log.Printf("Error executing %s command: %v", e.Language, err)
+		done.Status, done.Content = "error", fmt.Sprintf("Error: %v", err)
+	}
+	c.sendDoneMessage(req, done)
+}
+
+// languageExecutors are the languages besides Python and shell that get an executor when their
+// interpreter is installed, each keyed by its Language
+var languageExecutors = []*CommandExecutor{
+	{Language: "node", Command: []string{"node", "-e"}},
+	{Language: "julia", Command: []string{"julia", "-e"}},
+	{Language: "r", Command: []string{"Rscript", "-e"}},
+}
+
+func init() {
+	RegisterExecutor("python", clientExecutor{"python_done", (*Client).executePythonCode})
+	RegisterExecutor("shell", &CommandExecutor{Language: "shell", Command: []string{"sh", "-c"}})
+	pip := clientExecutor{"pip_done", (*Client).runPip}
+	RegisterExecutor("pip_install", pip)
+	RegisterExecutor("pip_uninstall", pip)
+	for _, executor := range languageExecutors {
+		if _, err := exec.LookPath(executor.Command[0]); err == nil {
+			RegisterExecutor(executor.Language, executor)
+		}
+	}
+}
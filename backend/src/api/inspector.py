@@ -0,0 +1,311 @@
+# PySync namespace inspector.
+#
+# Answers the variable inspector's and the editor's completion and
+# documentation requests from a live namespace without running a cell. The
+# built-in kernel runs with this file prepended to kernel.py; Jupyter kernels
+# for Python get it with every variable request and call inspection_result,
+# whose repr is the reply as JSON.
+
+import builtins
+import inspect
+import itertools
+import json
+import keyword
+import re
+import reprlib
+import types
+
+# Longest repr of a variable in a listing, and of one cell of a detailed view.
+REPR_LIMIT = 120
+CELL_LIMIT = 60
+# Widest dataframe or array row a detailed view shows.
+COLUMN_LIMIT = 100
+# Names IPython puts into the namespace of its own accord.
+IPYTHON_NAMES = {"In", "Out", "exit", "quit", "get_ipython"}
+
+_repr = reprlib.Repr()
+_repr.maxstring = _repr.maxother = REPR_LIMIT
+_repr.maxlist = _repr.maxtuple = _repr.maxset = _repr.maxdict = 10
+
+
+def short_repr(obj, limit=REPR_LIMIT):
+    """Returns repr(obj) on one line, cut to limit characters, without building the
+    repr of every element of a big container first."""
+    try:
+        text = _repr.repr(obj)
+    except Exception as err:
+        text = "<repr failed: %s>" % type(err).__name__
+    text = " ".join(text.split())
+    if len(text) > limit:
+        text = text[:limit - 3] + "..."
+    return text
+
+
+def type_name(obj):
+    return type(obj).__qualname__
+
+
+def shape_of(obj):
+    """Returns the shape of an array, dataframe or tensor, or None."""
+    if isinstance(obj, type):
+        return None
+    try:
+        shape = getattr(obj, "shape", None)
+    except Exception:
+        return None
+    if isinstance(shape, tuple) and all(isinstance(n, int) for n in shape):
+        return [int(n) for n in shape]
+    return None
+
+
+def size_of(obj):
+    if isinstance(obj, type):
+        return None
+    try:
+        return len(obj)
+    except Exception:
+        return None
+
+
+def is_user_variable(name, value):
+    return not name.startswith("_") and name not in IPYTHON_NAMES and not isinstance(value, types.ModuleType)
+
+
+def describe_variables(namespace):
+    """Lists the user-visible globals of namespace, sorted by name."""
+    variables = []
+    for name, value in sorted(namespace.items()):
+        if not is_user_variable(name, value):
+            continue
+        entry = {"name": name, "type": type_name(value), "repr": short_repr(value)}
+        shape = shape_of(value)
+        if shape is not None:
+            entry["shape"] = shape
+        else:
+            size = size_of(value)
+            if size is not None:
+                entry["size"] = size
+        variables.append(entry)
+    return variables
+
+
+def variable_kind(obj):
+    """Names the detailed view obj gets, or returns None if it has none."""
+    shape = shape_of(obj)
+    if shape is not None and hasattr(obj, "iloc"):
+        return "dataframe" if len(shape) == 2 and hasattr(obj, "columns") else "series"
+    if shape is not None and hasattr(obj, "dtype") and hasattr(obj, "__getitem__"):
+        return "array"
+    if isinstance(obj, dict) or (hasattr(obj, "keys") and hasattr(obj, "items") and hasattr(obj, "__getitem__")):
+        return "dict"
+    if isinstance(obj, (list, tuple)):
+        return "sequence"
+    return None
+
+
+def describe_variable(namespace, name, offset, limit):
+    """Returns the rows offset to offset+limit of the detailed view of a dataframe,
+    series, array, dict, list or tuple."""
+    if name not in namespace:
+        raise NameError("name %r is not defined" % name)
+    obj = namespace[name]
+    kind = variable_kind(obj)
+    if kind is None:
+        raise TypeError("%s is of type %s, not a dataframe, array or dict" % (name, type_name(obj)))
+
+    detail = {"name": name, "type": type_name(obj), "kind": kind, "offset": offset}
+    shape = shape_of(obj)
+    if shape is not None:
+        detail["shape"] = shape
+    cell = lambda value: short_repr(value, CELL_LIMIT)
+    end = offset + limit
+
+    if kind in ("dataframe", "series"):
+        detail["total"] = shape[0] if shape else 0
+        page = obj.iloc[offset:end]
+        detail["index"] = [cell(label) for label in page.index]
+        if kind == "dataframe":
+            columns = list(obj.columns)
+            detail["columns"] = [str(column) for column in columns[:COLUMN_LIMIT]]
+            detail["dtypes"] = [str(dtype) for dtype in list(obj.dtypes)[:COLUMN_LIMIT]]
+            detail["hidden_columns"] = max(0, len(columns) - COLUMN_LIMIT)
+            page = page.iloc[:, :COLUMN_LIMIT]
+            detail["rows"] = [[cell(value) for value in row] for row in page.itertuples(index=False)]
+        else:
+            detail["columns"] = [str(obj.name) if obj.name is not None else "value"]
+            detail["dtypes"] = [str(obj.dtype)]
+            detail["rows"] = [[cell(value)] for value in page]
+    elif kind == "array":
+        detail["dtypes"] = [str(obj.dtype)]
+        if not shape:
+            # A 0-d array is a single value
+            detail.update(total=1, columns=["value"], index=["0"], rows=[[cell(obj[()])]] if offset == 0 else [])
+            return detail
+        detail["total"] = shape[0]
+        page = obj[offset:end]
+        if len(shape) == 2:
+            detail["columns"] = [str(i) for i in range(min(shape[1], COLUMN_LIMIT))]
+            detail["hidden_columns"] = max(0, shape[1] - COLUMN_LIMIT)
+            detail["rows"] = [[cell(value) for value in row[:COLUMN_LIMIT]] for row in page]
+        else:
+            # Rows of higher-dimensional arrays are shown as the subarrays they are
+            detail["columns"] = ["value"]
+            detail["rows"] = [[cell(row)] for row in page]
+        detail["index"] = [str(i) for i in range(offset, offset + len(detail["rows"]))]
+    elif kind == "dict":
+        detail["total"] = len(obj)
+        detail["columns"] = ["value"]
+        items = list(itertools.islice(obj.items(), offset, end))
+        detail["index"] = [cell(key) for key, _ in items]
+        detail["rows"] = [[cell(value)] for _, value in items]
+    else:
+        detail["total"] = len(obj)
+        detail["columns"] = ["value"]
+        values = obj[offset:end]
+        detail["index"] = [str(i) for i in range(offset, offset + len(values))]
+        detail["rows"] = [[cell(value)] for value in values]
+    return detail
+
+
+# A dotted name ending at the cursor, such as "df.gro" or "os.path.jo".
+DOTTED_NAME = re.compile(r"[A-Za-z_][A-Za-z0-9_]*(?:\.[A-Za-z_][A-Za-z0-9_]*)*\.?$")
+IDENTIFIER_TAIL = re.compile(r"^[A-Za-z0-9_]*")
+
+
+def resolve(namespace, dotted):
+    """Looks up a dotted name in namespace, then builtins, without evaluating any
+    code but attribute access. Raises LookupError if it is not defined."""
+    parts = dotted.split(".")
+    if parts[0] in namespace:
+        obj = namespace[parts[0]]
+    elif hasattr(builtins, parts[0]):
+        obj = getattr(builtins, parts[0])
+    else:
+        raise LookupError(parts[0])
+    for part in parts[1:]:
+        try:
+            obj = getattr(obj, part)
+        except Exception:
+            raise LookupError(dotted)
+    return obj
+
+
+def complete(namespace, code, cursor):
+    """Returns the completions at cursor, a character offset into code, and the range
+    of code they replace."""
+    try:
+        import jedi
+    except ImportError:
+        jedi = None
+    if jedi is not None:
+        try:
+            lines = code[:cursor].split("\n")
+            completions = jedi.Interpreter(code, [namespace]).complete(len(lines), len(lines[-1]))
+            start = cursor - (completions[0].get_completion_prefix_length() if completions else 0)
+            return {"matches": [c.name for c in completions], "cursor_start": start, "cursor_end": cursor}
+        except Exception:
+            pass
+
+    match = DOTTED_NAME.search(code[:cursor])
+    token = match.group() if match else ""
+    if "." in token:
+        base, prefix = token.rsplit(".", 1)
+        try:
+            names = dir(resolve(namespace, base))
+        except LookupError:
+            names = []
+    else:
+        prefix = token
+        names = list(namespace) + dir(builtins) + keyword.kwlist
+    matches = sorted(set(
+        name for name in names
+        if name.startswith(prefix) and (prefix.startswith("_") or not name.startswith("_"))
+    ))
+    return {"matches": matches, "cursor_start": cursor - len(prefix), "cursor_end": cursor}
+
+
+def name_at(code, cursor):
+    """Returns the dotted name at cursor or, inside the arguments of a call, the name of
+    the function called."""
+    match = DOTTED_NAME.search(code[:cursor])
+    if match and match.group():
+        return match.group().rstrip(".") + IDENTIFIER_TAIL.match(code[cursor:]).group()
+    depth = 0
+    for i in range(cursor - 1, -1, -1):
+        if code[i] == ")":
+            depth += 1
+        elif code[i] == "(":
+            if depth == 0:
+                match = DOTTED_NAME.search(code[:i].rstrip())
+                return match.group().rstrip(".") if match else ""
+            depth -= 1
+    return ""
+
+
+def inspect_object(namespace, code, cursor, detail_level):
+    """Returns the signature and docstring of the object named at cursor and, at detail
+    level 1, its source."""
+    name = name_at(code, cursor)
+    if not name:
+        return {"found": False}
+    try:
+        obj = resolve(namespace, name)
+    except LookupError:
+        return {"found": False}
+
+    result = {"found": True, "name": name, "type": type_name(obj)}
+    if callable(obj):
+        try:
+            result["signature"] = name.rsplit(".", 1)[-1] + str(inspect.signature(obj))
+        except (TypeError, ValueError):
+            pass
+    doc = inspect.getdoc(obj)
+    if doc and (isinstance(obj, (type, types.FunctionType, types.BuiltinFunctionType, types.MethodType, types.ModuleType))
+                or doc != inspect.getdoc(type(obj))):
+        result["docstring"] = doc
+    elif not callable(obj):
+        # For plain values the value itself says more than the docstring of its type
+        result["docstring"] = short_repr(obj, REPR_LIMIT * 4)
+    if detail_level > 0:
+        try:
+            result["source"] = inspect.getsource(obj)
+        except (TypeError, OSError):
+            pass
+    return result
+
+
+def inspection_reply(namespace, request):
+    """Answers a variables, variable, complete or inspect request with the reply event
+    the kernel sends."""
+    kind = request.get("type")
+    reply = {"type": "%s_reply" % kind, "status": "ok"}
+    try:
+        if kind == "variables":
+            reply["variables"] = describe_variables(namespace)
+        elif kind == "variable":
+            reply["variable"] = describe_variable(
+                namespace, request.get("name", ""), request.get("offset", 0), request.get("limit", 0))
+        elif kind == "complete":
+            reply["completion"] = complete(namespace, request.get("code", ""), request.get("cursor_pos", 0))
+        elif kind == "inspect":
+            reply["inspection"] = inspect_object(
+                namespace, request.get("code", ""), request.get("cursor_pos", 0), request.get("detail_level", 0))
+        else:
+            raise ValueError("unknown inspection request: %s" % kind)
+    except Exception as err:
+        reply.update(status="error", ename=type(err).__name__, evalue=str(err))
+    return reply
+
+
+class JSONReply:
+    """Carries a reply out of a Jupyter kernel as the text/plain form of a user expression."""
+
+    def __init__(self, reply):
+        self.reply = reply
+
+    def __repr__(self):
+        return json.dumps(self.reply)
+
+
+def inspection_result(namespace, request):
+    return JSONReply(inspection_reply(namespace, request))
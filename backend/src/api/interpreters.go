@@ -0,0 +1,318 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// interpreterProbeTimeout bounds how long a candidate interpreter may take to report its version
+const interpreterProbeTimeout = 5 * time.Second
+
+// ErrNoInterpreter is returned when no Python interpreter is configured or found on PATH
+var ErrNoInterpreter = errors.New("no Python interpreter found: install python3 or select an interpreter")
+
+// Interpreter is a Python installation found on this machine
+type Interpreter struct {
+	Path    string `json:"path"`
+	Version string `json:"version"`
+	// Prefix is sys.prefix, which tells environments sharing one executable apart
+	Prefix string `json:"prefix"`
+	// executable is the resolved binary behind Path, which may be a symlink or a shim script
+	executable string
+	// Source is where the interpreter was found: "path", "virtualenv", "conda" or "project"
+	Source string `json:"source"`
+	// Name is the environment name for virtualenvs and conda envs
+	Name string `json:"name,omitempty"`
+}
+
+// pythonNames matches the executable names looked for in PATH directories
+var pythonNames = regexp.MustCompile(`^python(3(\.\d+)?)?$`)
+
+// probeScript prints what Interpreter needs to know, one value per line
+const probeScript = "import os, platform, sys; print(platform.python_version()); print(sys.prefix); print(os.path.realpath(sys.executable))"
+
+// probeInterpreter runs the interpreter at path to check that it works and read its version
+func probeInterpreter(path string, source string, name string) (Interpreter, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), interpreterProbeTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, path, "-c", probeScript).Output()
+	if err != nil {
+		return Interpreter{}, fmt.Errorf("%s is not a working Python interpreter: %w", path, err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) < 3 {
+		return Interpreter{}, fmt.Errorf("%s is not a working Python interpreter: unexpected output %q", path, out)
+	}
+	return Interpreter{
+		Path:       path,
+		Version:    strings.TrimSpace(lines[0]),
+		Prefix:     strings.TrimSpace(lines[1]),
+		executable: strings.TrimSpace(lines[2]),
+		Source:     source,
+		Name:       name,
+	}, nil
+}
+
+// interpreterCandidate is an executable that may be a Python interpreter
+type interpreterCandidate struct {
+	path   string
+	source string
+	name   string
+}
+
+// findInterpreterCandidates lists the places interpreters usually live: the project's .venv,
+// PATH, virtualenvwrapper's ~/.virtualenvs (or WORKON_HOME) and conda installations
+func findInterpreterCandidates(projectDir string) []interpreterCandidate {
+	var candidates []interpreterCandidate
+	add := func(path string, source string, name string) {
+		if info, err := os.Stat(path); err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+			candidates = append(candidates, interpreterCandidate{path, source, name})
+		}
+	}
+
+	if projectDir != "" {
+		add(filepath.Join(projectDir, ".venv", "bin", "python"), "project", ".venv")
+	}
+
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if pythonNames.MatchString(entry.Name()) {
+				add(filepath.Join(dir, entry.Name()), "path", "")
+			}
+		}
+	}
+
+	home, _ := os.UserHomeDir()
+	workon := os.Getenv("WORKON_HOME")
+	if workon == "" && home != "" {
+		workon = filepath.Join(home, ".virtualenvs")
+	}
+	for _, env := range subdirs(workon) {
+		add(filepath.Join(workon, env, "bin", "python"), "virtualenv", env)
+	}
+
+	for _, root := range condaRoots(home) {
+		add(filepath.Join(root, "bin", "python"), "conda", "base")
+		envs := filepath.Join(root, "envs")
+		for _, env := range subdirs(envs) {
+			add(filepath.Join(envs, env, "bin", "python"), "conda", env)
+		}
+	}
+	return candidates
+}
+
+// condaRoots returns the conda installations that exist, from CONDA_EXE or the usual
+// install locations in the home directory
+func condaRoots(home string) []string {
+	var roots []string
+	if condaExe := os.Getenv("CONDA_EXE"); condaExe != "" {
+		roots = append(roots, filepath.Dir(filepath.Dir(condaExe)))
+	}
+	if home != "" {
+		for _, name := range []string{"anaconda3", "miniconda3", "miniconda", "miniforge3", "mambaforge", ".conda"} {
+			roots = append(roots, filepath.Join(home, name))
+		}
+	}
+	roots = append(roots, "/opt/conda")
+
+	var existing []string
+	seen := map[string]bool{}
+	for _, root := range roots {
+		if info, err := os.Stat(root); err == nil && info.IsDir() && !seen[root] {
+			seen[root] = true
+			existing = append(existing, root)
+		}
+	}
+	return existing
+}
+
+func subdirs(dir string) []string {
+	if dir == "" {
+		return nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names
+}
+
+// DiscoverInterpreters probes every candidate interpreter in parallel and returns the working
+// ones. Several names for the same installation (python, python3 and python3.12 in one bin
+// directory, or pyenv shims) are reported once, under the first name found.
+func DiscoverInterpreters(projectDir string) []Interpreter {
+	candidates := findInterpreterCandidates(projectDir)
+	results := make([]*Interpreter, len(candidates))
+	var wg sync.WaitGroup
+	for i, candidate := range candidates {
+		wg.Add(1)
+		go func(i int, candidate interpreterCandidate) {
+			defer wg.Done()
+			if interp, err := probeInterpreter(candidate.path, candidate.source, candidate.name); err == nil {
+				results[i] = &interp
+			}
+		}(i, candidate)
+	}
+	wg.Wait()
+
+	var interpreters []Interpreter
+	seen := map[string]bool{}
+	for _, interp := range results {
+		if interp == nil {
+			continue
+		}
+		key := interp.executable + "\x00" + interp.Prefix
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		interpreters = append(interpreters, *interp)
+	}
+	sort.SliceStable(interpreters, func(i, j int) bool {
+		return sourceRank(interpreters[i].Source) < sourceRank(interpreters[j].Source)
+	})
+	return interpreters
+}
+
+func sourceRank(source string) int {
+	switch source {
+	case "project":
+		return 0
+	case "path":
+		return 1
+	case "virtualenv":
+		return 2
+	default:
+		return 3
+	}
+}
+
+var (
+	defaultPythonMu   sync.Mutex
+	defaultPythonPath string
+)
+
+// getPythonPath returns the server's default interpreter: the first python3 or python on PATH.
+// A failed lookup is not cached, so installing Python fixes the next request.
+func getPythonPath() (string, error) {
+	defaultPythonMu.Lock()
+	defer defaultPythonMu.Unlock()
+
+	if defaultPythonPath != "" {
+		return defaultPythonPath, nil
+	}
+	for _, name := range []string{"python3", "python"} {
+		if path, err := exec.LookPath(name); err == nil {
+			defaultPythonPath = path
+			return path, nil
+		}
+	}
+	return "", ErrNoInterpreter
+}
+
+// resolveInterpreter turns what a client selected, either a path or a command name looked up
+// on PATH, into a checked interpreter
+func resolveInterpreter(selection string) (Interpreter, error) {
+	selection = strings.TrimSpace(selection)
+	if selection == "" {
+		return Interpreter{}, errors.New("no interpreter given")
+	}
+	path := selection
+	if !strings.ContainsRune(selection, filepath.Separator) {
+		found, err := exec.LookPath(selection)
+		if err != nil {
+			return Interpreter{}, fmt.Errorf("interpreter %q not found on PATH", selection)
+		}
+		path = found
+	} else if abs, err := filepath.Abs(selection); err == nil {
+		path = abs
+	}
+	if _, err := os.Stat(path); err != nil {
+		return Interpreter{}, fmt.Errorf("interpreter %s does not exist", path)
+	}
+	return probeInterpreter(path, "selected", "")
+}
+
+// interpreterPath returns the interpreter the session runs, or "" if there is none
+func (c *Client) interpreterPath() string {
+	c.kernelMu.Lock()
+	path := c.pythonPath
+	c.kernelMu.Unlock()
+	if path != "" {
+		return path
+	}
+	path, _ = getPythonPath()
+	return path
+}
+
+// listInterpreters answers a list_interpreters request with the interpreters found on this
+// machine and the one the session currently uses
+func (c *Client) listInterpreters(req WebSocketMessage) {
+	projectDir := c.workspace()
+	listing := struct {
+		Current      string        `json:"current"`
+		Interpreters []Interpreter `json:"interpreters"`
+	}{
+		Current:      c.interpreterPath(),
+		Interpreters: DiscoverInterpreters(projectDir),
+	}
+	if listing.Interpreters == nil {
+		listing.Interpreters = []Interpreter{}
+	}
+
+	data, err := json.Marshal(listing)
+	if err != nil {
+		log.Printf("Error marshaling interpreters: %v", err)
+		c.sendDone(req, "interpreters", "error", fmt.Sprintf("Error: %v", err))
+		return
+	}
+	c.sendDone(req, "interpreters", "ok", string(data))
+}
+
+// selectInterpreter binds the session to the interpreter named in a select_interpreter request.
+// The running kernel, if any, is shut down so that the next cell starts on the new interpreter.
+func (c *Client) selectInterpreter(req WebSocketMessage) {
+	interp, err := resolveInterpreter(req.Content)
+	if err != nil {
+		log.Printf("Error selecting interpreter: %v", err)
+		c.sendDone(req, "interpreter_selected", "error", fmt.Sprintf("Error: %v", err))
+		return
+	}
+
+	c.kernelMu.Lock()
+	if interp.Path != c.pythonPath && c.kernel != nil {
+		c.closeKernelLocked()
+	}
+	c.pythonPath = interp.Path
+	c.kernelMu.Unlock()
+
+	data, err := json.Marshal(interp)
+	if err != nil {
+		c.sendDone(req, "interpreter_selected", "error", fmt.Sprintf("Error: %v", err))
+		return
+	}
+	log.Printf("Session interpreter set to %s (Python %s)", interp.Path, interp.Version)
+	c.sendDone(req, "interpreter_selected", "ok", string(data))
+}
@@ -0,0 +1,589 @@
+package jupyter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	connectTimeout    = 30 * time.Second
+	idleAfterReply    = 10 * time.Second
+	heartbeatInterval = 3 * time.Second
+	heartbeatMisses   = 3
+	shutdownGrace     = 3 * time.Second
+)
+
+// ErrKernelDied is returned when the kernel process exits while a request is in flight
+var ErrKernelDied = errors.New("kernel died")
+
+// ConnectionInfo is the content of the connection file handed to the kernel
+type ConnectionInfo struct {
+	ShellPort       int    `json:"shell_port"`
+	IOPubPort       int    `json:"iopub_port"`
+	StdinPort       int    `json:"stdin_port"`
+	ControlPort     int    `json:"control_port"`
+	HBPort          int    `json:"hb_port"`
+	IP              string `json:"ip"`
+	Key             string `json:"key"`
+	Transport       string `json:"transport"`
+	SignatureScheme string `json:"signature_scheme"`
+	KernelName      string `json:"kernel_name"`
+}
+
+// StartOptions configures the kernel process
+type StartOptions struct {
+	// Dir holds the kernel's connection file, and its sockets with the ipc transport; the system
+	// temp directory is used when empty
+	Dir string
+	// Transport is "tcp" (the default), for ports on the loopback interface, or "ipc", for unix
+	// sockets in Dir, which the server can reach in a kernel that has its own network namespace
+	Transport string
+	// Workdir is the working directory of the kernel, the server's when empty
+	Workdir string
+	// Env is appended to the server's environment and the kernelspec's env
+	Env []string
+	// Stdout and Stderr receive whatever the kernel process writes outside the protocol
+	Stdout io.Writer
+	Stderr io.Writer
+	// Prepare, if set, can adjust the kernel command before it starts
+	Prepare func(cmd *exec.Cmd) error
+}
+
+// Kernel is a running Jupyter kernel and the client connections to its five channels
+type Kernel struct {
+	spec     *KernelSpec
+	cmd      *exec.Cmd
+	connFile string
+	session  string
+	signer   signer
+
+	shell   *socket
+	control *socket
+	stdin   *socket
+	iopub   *socket
+	hb      endpoint
+
+	done    chan struct{}
+	waitErr error
+
+	mu      sync.Mutex
+	pending map[string]*request
+
+	closeOnce sync.Once
+}
+
+// request tracks the messages the kernel sends in response to one of ours
+type request struct {
+	// mu serializes onMessage, which is fed from both the iopub and stdin readers
+	mu        sync.Mutex
+	onMessage func(*Message)
+	reply     chan *Message
+	idle      chan struct{}
+	idleOnce  sync.Once
+}
+
+// Start launches the kernel described by spec and connects to it
+func Start(spec *KernelSpec, opts StartOptions) (*Kernel, error) {
+	var info ConnectionInfo
+	var err error
+	switch opts.Transport {
+	case "", "tcp":
+		info, err = allocatePorts()
+	case "ipc":
+		info, err = ipcConnection(opts.Dir)
+	default:
+		err = fmt.Errorf("unknown kernel transport %q", opts.Transport)
+	}
+	if err != nil {
+		return nil, err
+	}
+	info.Key = newID()
+	info.KernelName = spec.Name
+
+	connFile, err := writeConnectionFile(opts.Dir, info)
+	if err != nil {
+		return nil, err
+	}
+
+	argv := make([]string, len(spec.Argv))
+	for i, arg := range spec.Argv {
+		arg = strings.ReplaceAll(arg, "{connection_file}", connFile)
+		argv[i] = strings.ReplaceAll(arg, "{resource_dir}", spec.ResourceDir)
+	}
+
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Dir = opts.Workdir
+	cmd.Env = os.Environ()
+	for key, value := range spec.Env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	cmd.Env = append(cmd.Env, opts.Env...)
+	cmd.Stdout = opts.Stdout
+	cmd.Stderr = opts.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if opts.Prepare != nil {
+		if err := opts.Prepare(cmd); err != nil {
+			os.Remove(connFile)
+			return nil, err
+		}
+	}
+
+	if err := cmd.Start(); err != nil {
+		os.Remove(connFile)
+		return nil, fmt.Errorf("error starting kernel %s: %w", spec.Name, err)
+	}
+
+	k := &Kernel{
+		spec:     spec,
+		cmd:      cmd,
+		connFile: connFile,
+		session:  newID(),
+		signer:   signer{key: []byte(info.Key)},
+		done:     make(chan struct{}),
+		pending:  make(map[string]*request),
+	}
+	go func() {
+		k.waitErr = cmd.Wait()
+		close(k.done)
+		log.Printf("Jupyter kernel %s (%d) exited: %v", spec.Name, cmd.Process.Pid, k.waitErr)
+	}()
+
+	if err := k.connect(info); err != nil {
+		k.Close()
+		return nil, err
+	}
+	log.Printf("Started Jupyter kernel %s (%d)", spec.Name, cmd.Process.Pid)
+	return k, nil
+}
+
+// allocatePorts picks five free TCP ports on the loopback interface
+func allocatePorts() (ConnectionInfo, error) {
+	ports := make([]int, 5)
+	listeners := make([]net.Listener, 0, len(ports))
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+	for i := range ports {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return ConnectionInfo{}, fmt.Errorf("error allocating kernel port: %w", err)
+		}
+		listeners = append(listeners, l)
+		ports[i] = l.Addr().(*net.TCPAddr).Port
+	}
+	return ConnectionInfo{
+		ShellPort:       ports[0],
+		IOPubPort:       ports[1],
+		StdinPort:       ports[2],
+		ControlPort:     ports[3],
+		HBPort:          ports[4],
+		IP:              "127.0.0.1",
+		Transport:       "tcp",
+		SignatureScheme: "hmac-sha256",
+	}, nil
+}
+
+// ipcConnection names five unix sockets in dir. The kernel binds "<ip>-<port>" for each.
+func ipcConnection(dir string) (ConnectionInfo, error) {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return ConnectionInfo{}, err
+	}
+	return ConnectionInfo{
+		ShellPort:       1,
+		IOPubPort:       2,
+		StdinPort:       3,
+		ControlPort:     4,
+		HBPort:          5,
+		IP:              filepath.Join(dir, "kernel-"+newID()[:8]),
+		Transport:       "ipc",
+		SignatureScheme: "hmac-sha256",
+	}, nil
+}
+
+// endpoint is where one of the kernel's sockets listens
+type endpoint struct {
+	network string
+	address string
+}
+
+func (e endpoint) String() string {
+	return e.network + ":" + e.address
+}
+
+// endpoint returns where the kernel listens on port
+func (info ConnectionInfo) endpoint(port int) endpoint {
+	if info.Transport == "ipc" {
+		return endpoint{network: "unix", address: info.IP + "-" + strconv.Itoa(port)}
+	}
+	return endpoint{network: "tcp", address: net.JoinHostPort(info.IP, strconv.Itoa(port))}
+}
+
+func writeConnectionFile(dir string, info ConnectionInfo) (string, error) {
+	f, err := os.CreateTemp(dir, "kernel-*.json")
+	if err != nil {
+		return "", fmt.Errorf("error creating connection file: %w", err)
+	}
+	defer f.Close()
+	if err := json.NewEncoder(f).Encode(info); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("error writing connection file: %w", err)
+	}
+	return f.Name(), nil
+}
+
+func (k *Kernel) connect(info ConnectionInfo) error {
+	addr := info.endpoint
+
+	// The kernel sends input_request on stdin to the identity of the shell socket that made the
+	// execute_request, so both sockets share the session's identity
+	var err error
+	if k.shell, err = dialSocket(addr(info.ShellPort), "DEALER", k.session, connectTimeout, k.done); err != nil {
+		return err
+	}
+	if k.control, err = dialSocket(addr(info.ControlPort), "DEALER", "", connectTimeout, k.done); err != nil {
+		return err
+	}
+	if k.stdin, err = dialSocket(addr(info.StdinPort), "DEALER", k.session, connectTimeout, k.done); err != nil {
+		return err
+	}
+	if k.iopub, err = dialSocket(addr(info.IOPubPort), "SUB", "", connectTimeout, k.done); err != nil {
+		return err
+	}
+	if err := k.iopub.Subscribe(""); err != nil {
+		return err
+	}
+	k.hb = addr(info.HBPort)
+	hb, err := dialSocket(k.hb, "REQ", "", connectTimeout, k.done)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range []*socket{k.shell, k.control, k.stdin, k.iopub} {
+		go k.readLoop(s)
+	}
+
+	if err := k.waitReady(); err != nil {
+		return err
+	}
+	go k.heartbeat(hb)
+	return nil
+}
+
+// waitReady sends kernel_info_request until the reply's status messages come through on iopub,
+// which proves both that the kernel is up and that our subscription has taken effect
+func (k *Kernel) waitReady() error {
+	deadline := time.Now().Add(connectTimeout)
+	for time.Now().Before(deadline) {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		_, err := k.request(ctx, k.shell, "kernel_info_request", struct{}{}, true, nil)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if errors.Is(err, ErrKernelDied) {
+			return err
+		}
+	}
+	return errors.New("timed out waiting for kernel to become ready")
+}
+
+// readLoop receives messages from one channel and routes them to the request they answer
+func (k *Kernel) readLoop(s *socket) {
+	for {
+		parts, err := s.Recv()
+		if err != nil {
+			return
+		}
+		msg, err := k.signer.decode(parts)
+		if err != nil {
+			log.Printf("Dropping Jupyter message: %v", err)
+			continue
+		}
+		k.route(msg)
+	}
+}
+
+func (k *Kernel) route(msg *Message) {
+	k.mu.Lock()
+	req := k.pending[msg.ParentHeader.MsgID]
+	k.mu.Unlock()
+	if req == nil {
+		return
+	}
+
+	switch {
+	case msg.Header.MsgType == "status":
+		var status struct {
+			ExecutionState string `json:"execution_state"`
+		}
+		if msg.DecodeContent(&status) == nil && status.ExecutionState == "idle" {
+			req.idleOnce.Do(func() { close(req.idle) })
+		}
+	case strings.HasSuffix(msg.Header.MsgType, "_reply"):
+		select {
+		case req.reply <- msg:
+		default:
+		}
+	default:
+		if req.onMessage != nil {
+			req.mu.Lock()
+			req.onMessage(msg)
+			req.mu.Unlock()
+		}
+	}
+}
+
+// request sends a message on a channel and waits for its reply. For shell requests it also
+// waits for the kernel to go idle, so that all output has been delivered to onMessage.
+func (k *Kernel) request(ctx context.Context, s *socket, msgType string, content interface{}, waitIdle bool, onMessage func(*Message)) (*Message, error) {
+	msg, err := newMessage(k.session, msgType, content)
+	if err != nil {
+		return nil, err
+	}
+	req := &request{
+		onMessage: onMessage,
+		reply:     make(chan *Message, 1),
+		idle:      make(chan struct{}),
+	}
+
+	k.mu.Lock()
+	k.pending[msg.Header.MsgID] = req
+	k.mu.Unlock()
+	defer func() {
+		k.mu.Lock()
+		delete(k.pending, msg.Header.MsgID)
+		k.mu.Unlock()
+	}()
+
+	if err := k.send(s, msg); err != nil {
+		return nil, err
+	}
+
+	var reply *Message
+	select {
+	case reply = <-req.reply:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-k.done:
+		return nil, ErrKernelDied
+	}
+	if !waitIdle {
+		return reply, nil
+	}
+
+	select {
+	case <-req.idle:
+	case <-time.After(idleAfterReply):
+		log.Printf("Kernel did not report idle after %s", msgType)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-k.done:
+		return nil, ErrKernelDied
+	}
+	return reply, nil
+}
+
+func (k *Kernel) send(s *socket, msg *Message) error {
+	parts, err := k.signer.encode(msg)
+	if err != nil {
+		return fmt.Errorf("error encoding %s: %w", msg.Header.MsgType, err)
+	}
+	if err := s.Send(parts); err != nil {
+		return fmt.Errorf("error sending %s: %w", msg.Header.MsgType, err)
+	}
+	return nil
+}
+
+// Execute runs code and passes every iopub and stdin message it produces to onMessage.
+// It returns the execute_reply once the kernel has gone idle again.
+func (k *Kernel) Execute(ctx context.Context, code string, onMessage func(*Message)) (*Message, error) {
+	content := map[string]interface{}{
+		"code":             code,
+		"silent":           false,
+		"store_history":    true,
+		"user_expressions": map[string]interface{}{},
+		"allow_stdin":      true,
+		"stop_on_error":    true,
+	}
+	return k.request(ctx, k.shell, "execute_request", content, true, onMessage)
+}
+
+// Evaluate evaluates expressions in the kernel's namespace without running a cell: nothing is
+// printed, counted or kept in the history. The execute_reply holds the results in its
+// user_expressions, keyed like expressions.
+func (k *Kernel) Evaluate(ctx context.Context, expressions map[string]string) (*Message, error) {
+	content := map[string]interface{}{
+		"code":             "",
+		"silent":           true,
+		"store_history":    false,
+		"user_expressions": expressions,
+		"allow_stdin":      false,
+		"stop_on_error":    false,
+	}
+	return k.request(ctx, k.shell, "execute_request", content, false, nil)
+}
+
+// Complete asks the kernel for the completions at cursor, a character offset into code
+func (k *Kernel) Complete(ctx context.Context, code string, cursor int) (*Message, error) {
+	content := map[string]interface{}{"code": code, "cursor_pos": cursor}
+	return k.request(ctx, k.shell, "complete_request", content, false, nil)
+}
+
+// Inspect asks the kernel about the object at cursor; detailLevel 1 asks for more, such as
+// the source
+func (k *Kernel) Inspect(ctx context.Context, code string, cursor int, detailLevel int) (*Message, error) {
+	content := map[string]interface{}{"code": code, "cursor_pos": cursor, "detail_level": detailLevel}
+	return k.request(ctx, k.shell, "inspect_request", content, false, nil)
+}
+
+// InputReply answers an input_request the kernel sent on the stdin channel
+func (k *Kernel) InputReply(request *Message, value string) error {
+	msg, err := newMessage(k.session, "input_reply", map[string]string{"value": value})
+	if err != nil {
+		return err
+	}
+	msg.ParentHeader = request.Header
+	return k.send(k.stdin, msg)
+}
+
+// heartbeat pings the kernel and kills it once it stops answering, so that a hung kernel is
+// reported as dead instead of leaving requests waiting forever
+func (k *Kernel) heartbeat(hb *socket) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer func() {
+		ticker.Stop()
+		hb.Close()
+	}()
+
+	misses := 0
+	for {
+		select {
+		case <-k.done:
+			return
+		case <-ticker.C:
+		}
+
+		ping := []byte(newID())
+		hb.SetReadDeadline(time.Now().Add(heartbeatInterval))
+		err := hb.Send([][]byte{{}, ping})
+		if err == nil {
+			_, err = hb.Recv()
+		}
+		if err == nil {
+			misses = 0
+			continue
+		}
+		if !k.Alive() {
+			return
+		}
+		misses++
+		log.Printf("Jupyter kernel heartbeat missed (%d/%d): %v", misses, heartbeatMisses, err)
+		if misses >= heartbeatMisses {
+			k.Kill()
+			return
+		}
+		// A timed-out REQ socket is out of step with its peer, so start over on a fresh connection
+		hb.Close()
+		if hb, err = dialSocket(k.hb, "REQ", "", heartbeatInterval, k.done); err != nil {
+			k.Kill()
+			return
+		}
+	}
+}
+
+// Spec returns the kernelspec the kernel was started from
+func (k *Kernel) Spec() *KernelSpec {
+	return k.spec
+}
+
+// Pid returns the kernel's process ID, which is also its process group ID
+func (k *Kernel) Pid() int {
+	return k.cmd.Process.Pid
+}
+
+// ProcessState returns the exit state of the kernel process, or nil while it runs
+func (k *Kernel) ProcessState() *os.ProcessState {
+	select {
+	case <-k.done:
+		return k.cmd.ProcessState
+	default:
+		return nil
+	}
+}
+
+// Done is closed once the kernel process has exited
+func (k *Kernel) Done() <-chan struct{} {
+	return k.done
+}
+
+// Alive reports whether the kernel process is still running
+func (k *Kernel) Alive() bool {
+	select {
+	case <-k.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// Interrupt interrupts the running execution the way the kernelspec asks for: with an
+// interrupt_request on the control channel, or by default with SIGINT to the process group
+func (k *Kernel) Interrupt() error {
+	if k.spec.InterruptMode == "message" {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := k.request(ctx, k.control, "interrupt_request", struct{}{}, false, nil)
+		return err
+	}
+	return syscall.Kill(-k.cmd.Process.Pid, syscall.SIGINT)
+}
+
+// Kill terminates the kernel and every process in its process group
+func (k *Kernel) Kill() {
+	if k.Alive() {
+		syscall.Kill(-k.cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+// Close asks the kernel to shut down, kills it if it does not exit promptly, and releases
+// the connections and the connection file
+func (k *Kernel) Close() {
+	k.closeOnce.Do(func() {
+		if k.control != nil && k.Alive() {
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownGrace)
+			k.request(ctx, k.control, "shutdown_request", map[string]bool{"restart": false}, false, nil)
+			cancel()
+		}
+		select {
+		case <-k.done:
+		case <-time.After(shutdownGrace):
+			k.Kill()
+			<-k.done
+		}
+		for _, s := range []*socket{k.shell, k.control, k.stdin, k.iopub} {
+			if s != nil {
+				s.Close()
+			}
+		}
+		os.Remove(k.connFile)
+	})
+}
@@ -0,0 +1,146 @@
+package jupyter
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// KernelSpec describes how to launch a kernel, as read from a kernel.json file
+type KernelSpec struct {
+	Name          string            `json:"-"`
+	ResourceDir   string            `json:"-"`
+	Argv          []string          `json:"argv"`
+	DisplayName   string            `json:"display_name"`
+	Language      string            `json:"language"`
+	InterruptMode string            `json:"interrupt_mode,omitempty"`
+	Env           map[string]string `json:"env,omitempty"`
+}
+
+// kernelDirs returns the directories searched for kernelspecs, in priority order, following
+// the lookup rules of jupyter_client: JUPYTER_PATH, the user data dir, the prefix of the
+// given Python interpreter, then the system-wide locations
+func kernelDirs(pythonPath string) []string {
+	var dirs []string
+	if path := os.Getenv("JUPYTER_PATH"); path != "" {
+		for _, dir := range filepath.SplitList(path) {
+			dirs = append(dirs, filepath.Join(dir, "kernels"))
+		}
+	}
+
+	if dataDir := os.Getenv("JUPYTER_DATA_DIR"); dataDir != "" {
+		dirs = append(dirs, filepath.Join(dataDir, "kernels"))
+	} else if home, err := os.UserHomeDir(); err == nil {
+		if runtime.GOOS == "darwin" {
+			dirs = append(dirs, filepath.Join(home, "Library", "Jupyter", "kernels"))
+		} else {
+			dirs = append(dirs, filepath.Join(home, ".local", "share", "jupyter", "kernels"))
+		}
+	}
+
+	if pythonPath != "" {
+		prefix := filepath.Dir(filepath.Dir(pythonPath))
+		dirs = append(dirs, filepath.Join(prefix, "share", "jupyter", "kernels"))
+	}
+
+	return append(dirs, "/usr/local/share/jupyter/kernels", "/usr/share/jupyter/kernels")
+}
+
+// FindKernelSpecs returns the installed kernelspecs keyed by name. Specs found earlier in the
+// search path shadow later ones with the same name.
+func FindKernelSpecs(pythonPath string) map[string]*KernelSpec {
+	specs := map[string]*KernelSpec{}
+	for _, dir := range kernelDirs(pythonPath) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			name := strings.ToLower(entry.Name())
+			if _, seen := specs[name]; seen || !entry.IsDir() {
+				continue
+			}
+			spec, err := readKernelSpec(filepath.Join(dir, entry.Name()))
+			if err != nil {
+				continue
+			}
+			spec.Name = name
+			specs[name] = spec
+		}
+	}
+	return specs
+}
+
+func readKernelSpec(resourceDir string) (*KernelSpec, error) {
+	data, err := os.ReadFile(filepath.Join(resourceDir, "kernel.json"))
+	if err != nil {
+		return nil, err
+	}
+	var spec KernelSpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, fmt.Errorf("invalid kernel.json in %s: %w", resourceDir, err)
+	}
+	if len(spec.Argv) == 0 {
+		return nil, fmt.Errorf("kernel.json in %s has no argv", resourceDir)
+	}
+	spec.ResourceDir = resourceDir
+	return &spec, nil
+}
+
+// ResolveKernelSpec looks up a kernelspec by name. The name "python3" falls back to running
+// ipykernel from the given interpreter when no spec of that name is installed, which is what
+// `pip install ipykernel` alone gives you. An ipykernel spec runs with the given interpreter
+// rather than the one it names, so that the kernel follows the session's interpreter, unless
+// that interpreter has no ipykernel.
+func ResolveKernelSpec(name string, pythonPath string) (*KernelSpec, error) {
+	if name == "" {
+		name = "python3"
+	}
+	specs := FindKernelSpecs(pythonPath)
+	if spec, ok := specs[strings.ToLower(name)]; ok {
+		if isIPyKernel(spec) && pythonPath != "" && spec.Argv[0] != pythonPath && canRunIPyKernel(pythonPath) {
+			spec.Argv = append([]string{pythonPath}, spec.Argv[1:]...)
+		}
+		return spec, nil
+	}
+
+	if name == "python3" && pythonPath != "" && canRunIPyKernel(pythonPath) {
+		return &KernelSpec{
+			Name:        "python3",
+			Argv:        []string{pythonPath, "-m", "ipykernel_launcher", "-f", "{connection_file}"},
+			DisplayName: "Python 3 (ipykernel)",
+			Language:    "python",
+		}, nil
+	}
+
+	available := make([]string, 0, len(specs))
+	for specName := range specs {
+		available = append(available, specName)
+	}
+	sort.Strings(available)
+	return nil, fmt.Errorf("no kernelspec named %q (available: %s)", name, strings.Join(available, ", "))
+}
+
+// isIPyKernel reports whether spec runs ipykernel with a Python interpreter, as
+// `python -m ipykernel_launcher -f {connection_file}` does
+func isIPyKernel(spec *KernelSpec) bool {
+	if !strings.EqualFold(spec.Language, "python") {
+		return false
+	}
+	for i := 1; i+1 < len(spec.Argv); i++ {
+		if spec.Argv[i] == "-m" {
+			return spec.Argv[i+1] == "ipykernel_launcher" || spec.Argv[i+1] == "ipykernel"
+		}
+	}
+	return false
+}
+
+// canRunIPyKernel reports whether ipykernel is installed for the interpreter at pythonPath
+func canRunIPyKernel(pythonPath string) bool {
+	return exec.Command(pythonPath, "-c", "import ipykernel_launcher").Run() == nil
+}
@@ -0,0 +1,146 @@
+package jupyter
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// protocolVersion is the Jupyter messaging protocol version this client speaks
+const protocolVersion = "5.3"
+
+var delimiter = []byte("<IDS|MSG>")
+
+// Header is the header (and parent header) of a Jupyter message
+type Header struct {
+	MsgID    string `json:"msg_id,omitempty"`
+	Session  string `json:"session,omitempty"`
+	Username string `json:"username,omitempty"`
+	Date     string `json:"date,omitempty"`
+	MsgType  string `json:"msg_type,omitempty"`
+	Version  string `json:"version,omitempty"`
+}
+
+// Message is a Jupyter protocol message as described in
+// https://jupyter-client.readthedocs.io/en/latest/messaging.html
+type Message struct {
+	Identities   [][]byte
+	Header       Header
+	ParentHeader Header
+	Metadata     map[string]interface{}
+	Content      json.RawMessage
+	Buffers      [][]byte
+}
+
+// DecodeContent unmarshals the message content into v
+func (m *Message) DecodeContent(v interface{}) error {
+	return json.Unmarshal(m.Content, v)
+}
+
+// newID returns a random hex identifier for messages and sessions
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// signer computes and checks the HMAC signature of messages
+type signer struct {
+	key []byte
+}
+
+func (s signer) sign(parts ...[]byte) []byte {
+	if len(s.key) == 0 {
+		return nil
+	}
+	mac := hmac.New(sha256.New, s.key)
+	for _, part := range parts {
+		mac.Write(part)
+	}
+	sum := mac.Sum(nil)
+	out := make([]byte, hex.EncodedLen(len(sum)))
+	hex.Encode(out, sum)
+	return out
+}
+
+// encode serializes a message into ZMTP frames
+func (s signer) encode(msg *Message) ([][]byte, error) {
+	header, err := json.Marshal(msg.Header)
+	if err != nil {
+		return nil, err
+	}
+	parent, err := json.Marshal(msg.ParentHeader)
+	if err != nil {
+		return nil, err
+	}
+	metadata := msg.Metadata
+	if metadata == nil {
+		metadata = map[string]interface{}{}
+	}
+	meta, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+	content := []byte(msg.Content)
+	if len(content) == 0 {
+		content = []byte("{}")
+	}
+
+	parts := make([][]byte, 0, len(msg.Identities)+6+len(msg.Buffers))
+	parts = append(parts, msg.Identities...)
+	parts = append(parts, delimiter, s.sign(header, parent, meta, content), header, parent, meta, content)
+	parts = append(parts, msg.Buffers...)
+	return parts, nil
+}
+
+// decode parses and verifies ZMTP frames received from the kernel
+func (s signer) decode(parts [][]byte) (*Message, error) {
+	i := 0
+	for i < len(parts) && !bytes.Equal(parts[i], delimiter) {
+		i++
+	}
+	if len(parts)-i < 6 {
+		return nil, errors.New("malformed message: missing delimiter or frames")
+	}
+	signature, header, parent, meta, content := parts[i+1], parts[i+2], parts[i+3], parts[i+4], parts[i+5]
+	if expected := s.sign(header, parent, meta, content); expected != nil && !hmac.Equal(expected, signature) {
+		return nil, errors.New("invalid message signature")
+	}
+
+	msg := &Message{Identities: parts[:i], Content: json.RawMessage(content), Buffers: parts[i+6:]}
+	if err := json.Unmarshal(header, &msg.Header); err != nil {
+		return nil, fmt.Errorf("invalid header: %w", err)
+	}
+	if err := json.Unmarshal(parent, &msg.ParentHeader); err != nil {
+		return nil, fmt.Errorf("invalid parent header: %w", err)
+	}
+	if err := json.Unmarshal(meta, &msg.Metadata); err != nil {
+		return nil, fmt.Errorf("invalid metadata: %w", err)
+	}
+	return msg, nil
+}
+
+// newMessage builds a request of the given type for this session
+func newMessage(session string, msgType string, content interface{}) (*Message, error) {
+	data, err := json.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{
+		Header: Header{
+			MsgID:    newID(),
+			Session:  session,
+			Username: "pysync",
+			Date:     time.Now().UTC().Format(time.RFC3339Nano),
+			MsgType:  msgType,
+			Version:  protocolVersion,
+		},
+		Content: data,
+	}, nil
+}
@@ -0,0 +1,115 @@
+package jupyter
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	msg, err := newMessage("session", "execute_request", map[string]string{"code": "1 + 1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Identities = [][]byte{[]byte("kernel")}
+	msg.ParentHeader = Header{MsgID: "parent"}
+	msg.Metadata = map[string]interface{}{"cell": "a"}
+	msg.Buffers = [][]byte{[]byte("buffer")}
+
+	for _, key := range []string{"secret", ""} {
+		s := signer{key: []byte(key)}
+		parts, err := s.encode(msg)
+		if err != nil {
+			t.Fatalf("key %q: encode: %v", key, err)
+		}
+		got, err := s.decode(parts)
+		if err != nil {
+			t.Fatalf("key %q: decode: %v", key, err)
+		}
+		if got.Header != msg.Header || got.ParentHeader != msg.ParentHeader {
+			t.Errorf("key %q: got headers %+v, %+v", key, got.Header, got.ParentHeader)
+		}
+		var content map[string]string
+		if err := got.DecodeContent(&content); err != nil || content["code"] != "1 + 1" {
+			t.Errorf("key %q: got content %s", key, got.Content)
+		}
+		if got.Metadata["cell"] != "a" {
+			t.Errorf("key %q: got metadata %v", key, got.Metadata)
+		}
+		if len(got.Identities) != 1 || string(got.Identities[0]) != "kernel" {
+			t.Errorf("key %q: got identities %q", key, got.Identities)
+		}
+		if len(got.Buffers) != 1 || string(got.Buffers[0]) != "buffer" {
+			t.Errorf("key %q: got buffers %q", key, got.Buffers)
+		}
+	}
+}
+
+func TestSignature(t *testing.T) {
+	key := []byte("secret")
+	msg, err := newMessage("session", "kernel_info_request", map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// parts are [delimiter, signature, header, parent, metadata, content]
+	encode := func() [][]byte {
+		parts, err := signer{key: key}.encode(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parts
+	}
+
+	tests := []struct {
+		name    string
+		key     string
+		tamper  func(parts [][]byte) [][]byte
+		wantErr string
+	}{
+		{"valid", "secret", func(p [][]byte) [][]byte { return p }, ""},
+		{"wrong key", "other", func(p [][]byte) [][]byte { return p }, "invalid message signature"},
+		{"changed content", "secret", func(p [][]byte) [][]byte {
+			p[5] = []byte(`{"code": "import os"}`)
+			return p
+		}, "invalid message signature"},
+		{"changed header", "secret", func(p [][]byte) [][]byte {
+			p[2] = bytes.Replace(p[2], []byte("kernel_info_request"), []byte("shutdown_request"), 1)
+			return p
+		}, "invalid message signature"},
+		{"no signature", "secret", func(p [][]byte) [][]byte {
+			p[1] = nil
+			return p
+		}, "invalid message signature"},
+		{"unsigned without key", "", func(p [][]byte) [][]byte {
+			p[1] = nil
+			return p
+		}, ""},
+		{"missing delimiter", "secret", func(p [][]byte) [][]byte { return p[1:] }, "malformed message"},
+		{"missing frames", "secret", func(p [][]byte) [][]byte { return p[:4] }, "malformed message"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := signer{key: []byte(tt.key)}.decode(tt.tamper(encode()))
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("got error %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSignMatchesJupyter(t *testing.T) {
+	// The HMAC-SHA256 of the frames in order, hex encoded, as jupyter_client's Session.sign
+	// computes it
+	got := signer{key: []byte("key")}.sign(
+		[]byte(`{"msg_type":"status"}`), []byte("{}"), []byte("{}"), []byte(`{"execution_state":"idle"}`))
+	want := "14e36fef7b8277da75c184d9a85d44a5baea0531d2363b29b39a734acd352f90"
+	if string(got) != want {
+		t.Errorf("got signature %s, want %s", got, want)
+	}
+	if sig := (signer{}).sign([]byte("{}")); sig != nil {
+		t.Errorf("got signature %q without a key", sig)
+	}
+}
@@ -0,0 +1,248 @@
+package jupyter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// This file implements just enough of ZMTP 3.0 (https://rfc.zeromq.org/spec/23/) to talk to a
+// Jupyter kernel: a single outgoing TCP or unix socket connection per socket, the NULL security
+// mechanism, and the DEALER, SUB and REQ socket types the client side of the kernel protocol uses.
+
+const (
+	flagMore    = 0x01
+	flagLong    = 0x02
+	flagCommand = 0x04
+
+	greetingSize = 64
+	maxFrameSize = 512 * 1024 * 1024
+)
+
+// socket is a connected ZMTP peer
+type socket struct {
+	conn       net.Conn
+	reader     *bufio.Reader
+	socketType string
+	// identity is announced to ROUTER peers, which address replies by it
+	identity string
+
+	writeMu sync.Mutex
+	readMu  sync.Mutex
+}
+
+// dialSocket connects to a ZMTP endpoint, retrying until timeout while the kernel is still
+// starting up and has not bound its ports yet. It gives up early once abort is closed. An empty
+// identity lets the peer assign one.
+func dialSocket(addr endpoint, socketType string, identity string, timeout time.Duration, abort <-chan struct{}) (*socket, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err := net.DialTimeout(addr.network, addr.address, time.Second)
+		if err == nil {
+			s := &socket{conn: conn, reader: bufio.NewReader(conn), socketType: socketType, identity: identity}
+			if err := s.handshake(deadline); err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("handshake with %s failed: %w", addr, err)
+			}
+			return s, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
+		}
+		select {
+		case <-abort:
+			return nil, fmt.Errorf("failed to connect to %s: kernel exited", addr)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func (s *socket) handshake(deadline time.Time) error {
+	s.conn.SetDeadline(deadline)
+	defer s.conn.SetDeadline(time.Time{})
+
+	greeting := make([]byte, greetingSize)
+	greeting[0] = 0xFF
+	greeting[9] = 0x7F
+	greeting[10] = 3 // major version
+	greeting[11] = 0 // minor version
+	copy(greeting[12:32], "NULL")
+	if _, err := s.conn.Write(greeting); err != nil {
+		return err
+	}
+
+	peer := make([]byte, greetingSize)
+	if _, err := io.ReadFull(s.reader, peer); err != nil {
+		return err
+	}
+	if peer[0] != 0xFF || peer[9] != 0x7F {
+		return errors.New("peer did not send a ZMTP signature")
+	}
+	if peer[10] < 3 {
+		return fmt.Errorf("unsupported ZMTP version %d.%d", peer[10], peer[11])
+	}
+	if mechanism := string(bytes.TrimRight(peer[12:32], "\x00")); mechanism != "NULL" {
+		return fmt.Errorf("unsupported security mechanism %q", mechanism)
+	}
+
+	props := map[string]string{"Socket-Type": s.socketType}
+	if s.identity != "" {
+		props["Identity"] = s.identity
+	}
+	ready := commandBody("READY", props)
+	if err := s.writeFrame(ready, flagCommand); err != nil {
+		return err
+	}
+
+	for {
+		body, flags, err := s.readFrame()
+		if err != nil {
+			return err
+		}
+		if flags&flagCommand == 0 {
+			return errors.New("peer sent a message before READY")
+		}
+		name, props := parseCommand(body)
+		switch name {
+		case "READY":
+			return nil
+		case "ERROR":
+			return fmt.Errorf("peer rejected handshake: %s", props[""])
+		}
+	}
+}
+
+// commandBody encodes a ZMTP command with its metadata properties
+func commandBody(name string, props map[string]string) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(byte(len(name)))
+	buf.WriteString(name)
+	for key, value := range props {
+		buf.WriteByte(byte(len(key)))
+		buf.WriteString(key)
+		binary.Write(&buf, binary.BigEndian, uint32(len(value)))
+		buf.WriteString(value)
+	}
+	return buf.Bytes()
+}
+
+// parseCommand decodes a command name. An ERROR command's reason is returned under the "" key;
+// the properties of other commands are not needed by this client.
+func parseCommand(body []byte) (string, map[string]string) {
+	props := map[string]string{}
+	if len(body) == 0 || int(body[0]) >= len(body) {
+		return "", props
+	}
+	name := string(body[1 : 1+body[0]])
+	rest := body[1+body[0]:]
+	if name == "ERROR" && len(rest) > 0 && int(rest[0]) < len(rest) {
+		props[""] = string(rest[1 : 1+rest[0]])
+	}
+	return name, props
+}
+
+func (s *socket) writeFrame(body []byte, flags byte) error {
+	var header [9]byte
+	n := 2
+	if len(body) > 255 {
+		header[0] = flags | flagLong
+		binary.BigEndian.PutUint64(header[1:], uint64(len(body)))
+		n = 9
+	} else {
+		header[0] = flags
+		header[1] = byte(len(body))
+	}
+	if _, err := s.conn.Write(header[:n]); err != nil {
+		return err
+	}
+	_, err := s.conn.Write(body)
+	return err
+}
+
+func (s *socket) readFrame() ([]byte, byte, error) {
+	flags, err := s.reader.ReadByte()
+	if err != nil {
+		return nil, 0, err
+	}
+	var size uint64
+	if flags&flagLong != 0 {
+		var long [8]byte
+		if _, err := io.ReadFull(s.reader, long[:]); err != nil {
+			return nil, 0, err
+		}
+		size = binary.BigEndian.Uint64(long[:])
+	} else {
+		short, err := s.reader.ReadByte()
+		if err != nil {
+			return nil, 0, err
+		}
+		size = uint64(short)
+	}
+	if size > maxFrameSize {
+		return nil, 0, fmt.Errorf("frame of %d bytes exceeds limit", size)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(s.reader, body); err != nil {
+		return nil, 0, err
+	}
+	return body, flags, nil
+}
+
+// Send writes a multipart message
+func (s *socket) Send(parts [][]byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	for i, part := range parts {
+		var flags byte
+		if i < len(parts)-1 {
+			flags = flagMore
+		}
+		if err := s.writeFrame(part, flags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Recv reads the next multipart message, skipping any commands the peer sends in between
+func (s *socket) Recv() ([][]byte, error) {
+	s.readMu.Lock()
+	defer s.readMu.Unlock()
+
+	var parts [][]byte
+	for {
+		body, flags, err := s.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		if flags&flagCommand != 0 {
+			continue
+		}
+		parts = append(parts, body)
+		if flags&flagMore == 0 {
+			return parts, nil
+		}
+	}
+}
+
+// Subscribe registers a topic prefix on a SUB socket; ZMTP 3.0 carries subscriptions as a
+// message whose first byte is 1
+func (s *socket) Subscribe(topic string) error {
+	return s.Send([][]byte{append([]byte{1}, topic...)})
+}
+
+// SetReadDeadline bounds the next Recv
+func (s *socket) SetReadDeadline(t time.Time) error {
+	return s.conn.SetReadDeadline(t)
+}
+
+func (s *socket) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,167 @@
+package jupyter
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// socketPair returns the two ends of a unix socket connection as ZMTP sockets, skipping the
+// handshake. net.Pipe would not do: it blocks empty writes until a read takes them.
+func socketPair(t *testing.T) (*socket, *socket) {
+	t.Helper()
+	listener, err := net.Listen("unix", t.TempDir()+"/zmtp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+	a, err := net.Dial("unix", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := <-accepted
+	if b == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return &socket{conn: a, reader: bufio.NewReader(a)}, &socket{conn: b, reader: bufio.NewReader(b)}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		parts [][]byte
+	}{
+		{"empty frame", [][]byte{{}}},
+		{"single frame", [][]byte{[]byte("hello")}},
+		{"multipart", [][]byte{[]byte("a"), {}, []byte("<IDS|MSG>"), []byte("{}")}},
+		{"largest short frame", [][]byte{bytes.Repeat([]byte("s"), 255)}},
+		{"smallest long frame", [][]byte{bytes.Repeat([]byte("l"), 256)}},
+		{"long frames", [][]byte{bytes.Repeat([]byte("x"), 70000), []byte("end")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender, receiver := socketPair(t)
+			errs := make(chan error, 1)
+			go func() { errs <- sender.Send(tt.parts) }()
+			got, err := receiver.Recv()
+			if err != nil {
+				t.Fatalf("Recv: %v", err)
+			}
+			if err := <-errs; err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+			if len(got) != len(tt.parts) {
+				t.Fatalf("got %d parts, want %d", len(got), len(tt.parts))
+			}
+			for i := range got {
+				if !bytes.Equal(got[i], tt.parts[i]) {
+					t.Errorf("part %d: got %d bytes %.20q, want %d bytes %.20q", i, len(got[i]), got[i], len(tt.parts[i]), tt.parts[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRecvSkipsCommands(t *testing.T) {
+	sender, receiver := socketPair(t)
+	go func() {
+		sender.writeFrame(commandBody("PING", nil), flagCommand)
+		sender.Send([][]byte{[]byte("one"), []byte("two")})
+	}()
+	got, err := receiver.Recv()
+	if err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+	if len(got) != 2 || string(got[0]) != "one" || string(got[1]) != "two" {
+		t.Errorf("got %q, want [one two]", got)
+	}
+}
+
+func TestReadFrameLimit(t *testing.T) {
+	sender, receiver := socketPair(t)
+	go func() {
+		header := []byte{flagLong, 0, 0, 0, 0, 0x40, 0, 0, 0}
+		sender.conn.Write(header)
+	}()
+	if _, _, err := receiver.readFrame(); err == nil || !strings.Contains(err.Error(), "exceeds limit") {
+		t.Errorf("got error %v, want a frame size error", err)
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	errorBody := append([]byte{5}, "ERROR"...)
+	errorBody = append(errorBody, 6)
+	errorBody = append(errorBody, "denied"...)
+	tests := []struct {
+		name     string
+		body     []byte
+		wantName string
+		reason   string
+	}{
+		{"ready", commandBody("READY", map[string]string{"Socket-Type": "DEALER"}), "READY", ""},
+		{"error", errorBody, "ERROR", "denied"},
+		{"empty", nil, "", ""},
+		{"truncated name", []byte{9, 'R', 'E'}, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, props := parseCommand(tt.body)
+			if name != tt.wantName || props[""] != tt.reason {
+				t.Errorf("got %q with reason %q, want %q with reason %q", name, props[""], tt.wantName, tt.reason)
+			}
+		})
+	}
+}
+
+func TestDialSocketHandshake(t *testing.T) {
+	listener, err := net.Listen("unix", t.TempDir()+"/zmtp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	peer := make(chan *socket, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(peer)
+			return
+		}
+		s := &socket{conn: conn, reader: bufio.NewReader(conn), socketType: "ROUTER"}
+		if err := s.handshake(time.Now().Add(5 * time.Second)); err != nil {
+			conn.Close()
+			close(peer)
+			return
+		}
+		peer <- s
+	}()
+
+	client, err := dialSocket(endpoint{"unix", listener.Addr().String()}, "DEALER", "client", 5*time.Second, nil)
+	if err != nil {
+		t.Fatalf("dialSocket: %v", err)
+	}
+	defer client.Close()
+	server, ok := <-peer
+	if !ok {
+		t.Fatal("the peer's handshake failed")
+	}
+	defer server.Close()
+
+	go client.Send([][]byte{[]byte("request")})
+	got, err := server.Recv()
+	if err != nil || len(got) != 1 || string(got[0]) != "request" {
+		t.Errorf("got %q, %v; want [request]", got, err)
+	}
+}
@@ -0,0 +1,358 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+
+	"emad/pysync/api/jupyter"
+)
+
+// startKernel starts the kernel selected by the PYSYNC_KERNEL setting: empty or "builtin" for
+// the built-in Python kernel, "jupyter" for the python3 Jupyter kernel, or "jupyter:<name>"
+// for any other installed kernelspec
+func startKernel(selection string, pythonPath string, options ProcessOptions) (Kernel, error) {
+	var specName string
+	switch {
+	case selection == "" || selection == "builtin":
+		kernel, err := StartPythonKernel(pythonPath, options)
+		if err != nil {
+			return nil, err
+		}
+		return kernel, nil
+	case selection == "jupyter":
+		specName = "python3"
+	case strings.HasPrefix(selection, "jupyter:"):
+		specName = strings.TrimPrefix(selection, "jupyter:")
+	default:
+		return nil, fmt.Errorf("unknown kernel %q", selection)
+	}
+
+	kernel, err := startJupyterKernel(specName, pythonPath, options)
+	if err != nil {
+		return nil, err
+	}
+	return kernel, nil
+}
+
+// jupyterKernel adapts a Jupyter protocol kernel to the Kernel interface, translating iopub
+// messages into the same events the built-in kernel produces
+type jupyterKernel struct {
+	*jupyter.Kernel
+	dir    string
+	limits *processLimits
+	exit   *exitDiagnosis
+
+	// inputRequest is the input_request the running cell waits on, if any
+	inputMu      sync.Mutex
+	inputRequest *jupyter.Message
+}
+
+func startJupyterKernel(specName string, pythonPath string, options ProcessOptions) (*jupyterKernel, error) {
+	spec, err := jupyter.ResolveKernelSpec(specName, pythonPath)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp("", "jupyter_kernel_")
+	if err != nil {
+		return nil, fmt.Errorf("error creating kernel directory: %w", err)
+	}
+	// A kernel in its own network namespace has a loopback of its own, which the server cannot
+	// reach, so it listens on unix sockets in the kernel directory instead
+	transport := "tcp"
+	if options.Sandbox.Enabled && !options.Sandbox.Network {
+		transport = "ipc"
+	}
+	var limited *processLimits
+	exit := newExitDiagnosis()
+	kernel, err := jupyter.Start(spec, jupyter.StartOptions{
+		Dir:       dir,
+		Transport: transport,
+		Workdir:   options.Workdir,
+		Stdout:    log.Writer(),
+		Stderr:    log.Writer(),
+		Prepare: func(cmd *exec.Cmd) error {
+			var err error
+			// The connection file and the ipc sockets have to be visible in the sandbox
+			limited, err = confine(cmd, options, dir)
+			return err
+		},
+	})
+	if err != nil {
+		limited.release()
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return &jupyterKernel{Kernel: kernel, dir: dir, limits: limited, exit: exit}, nil
+}
+
+// ansiEscape matches the terminal color codes IPython puts into tracebacks
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;]*[A-Za-z]`)
+
+func (k *jupyterKernel) Execute(ctx context.Context, code string, options ExecuteOptions, onEvent func(KernelEvent)) (KernelEvent, error) {
+	if options.Profile {
+		return KernelEvent{}, fmt.Errorf("profiling needs the built-in kernel, not the %s Jupyter kernel", k.Spec().Name)
+	}
+	reply, err := k.Kernel.Execute(ctx, code, func(msg *jupyter.Message) {
+		switch msg.Header.MsgType {
+		case "stream":
+			var content struct {
+				Name string `json:"name"`
+				Text string `json:"text"`
+			}
+			if msg.DecodeContent(&content) == nil {
+				onEvent(KernelEvent{Type: "stream", Name: content.Name, Text: content.Text})
+			}
+		case "error":
+			var content struct {
+				Traceback []string `json:"traceback"`
+			}
+			if msg.DecodeContent(&content) == nil {
+				text := ansiEscape.ReplaceAllString(strings.Join(content.Traceback, "\n"), "")
+				onEvent(KernelEvent{Type: "stream", Name: "stderr", Text: text + "\n"})
+			}
+		case "input_request":
+			var content struct {
+				Prompt   string `json:"prompt"`
+				Password bool   `json:"password"`
+			}
+			if msg.DecodeContent(&content) == nil {
+				k.inputMu.Lock()
+				k.inputRequest = msg
+				k.inputMu.Unlock()
+				onEvent(KernelEvent{Type: "input_request", Prompt: content.Prompt, Password: content.Password})
+			}
+		case "execute_result", "display_data":
+			var content struct {
+				Data     map[string]interface{} `json:"data"`
+				Metadata map[string]interface{} `json:"metadata"`
+			}
+			if msg.DecodeContent(&content) == nil {
+				onEvent(KernelEvent{Type: msg.Header.MsgType, Data: content.Data, Metadata: content.Metadata})
+			}
+		}
+	})
+	if errors.Is(err, jupyter.ErrKernelDied) {
+		return KernelEvent{}, kernelDied(k.ProcessState())
+	}
+	if err != nil {
+		return KernelEvent{}, err
+	}
+
+	// The reply's traceback is formatted text, so there are no frames to report
+	var content struct {
+		Status string `json:"status"`
+		Ename  string `json:"ename"`
+		Evalue string `json:"evalue"`
+	}
+	if err := reply.DecodeContent(&content); err != nil {
+		return KernelEvent{}, fmt.Errorf("invalid execute_reply: %w", err)
+	}
+	return KernelEvent{Type: "execute_reply", Status: content.Status, Ename: content.Ename, Evalue: content.Evalue}, nil
+}
+
+func (k *jupyterKernel) Variables(ctx context.Context) ([]VariableSummary, error) {
+	reply, err := k.inspect(ctx, kernelRequest{Type: "variables"})
+	return reply.Variables, err
+}
+
+func (k *jupyterKernel) Variable(ctx context.Context, name string, offset, limit int) (*VariableDetail, error) {
+	reply, err := k.inspect(ctx, kernelRequest{Type: "variable", Name: name, Offset: offset, Limit: limit})
+	return reply.Variable, err
+}
+
+func (k *jupyterKernel) Complete(ctx context.Context, code string, cursor int) (*Completion, error) {
+	reply, err := k.Kernel.Complete(ctx, code, cursor)
+	if errors.Is(err, jupyter.ErrKernelDied) {
+		return nil, kernelDied(k.ProcessState())
+	}
+	if err != nil {
+		return nil, err
+	}
+	var content struct {
+		Status string `json:"status"`
+		Ename  string `json:"ename"`
+		Evalue string `json:"evalue"`
+		Completion
+	}
+	if err := reply.DecodeContent(&content); err != nil {
+		return nil, fmt.Errorf("invalid complete_reply: %w", err)
+	}
+	if content.Status != "ok" {
+		return nil, fmt.Errorf("%s: %s", content.Ename, content.Evalue)
+	}
+	if content.Matches == nil {
+		content.Matches = []string{}
+	}
+	return &content.Completion, nil
+}
+
+// inspectSections are the headings of IPython's object descriptions and the Inspection field
+// each one fills; the first heading found wins
+var inspectSections = []struct {
+	heading string
+	field   func(*Inspection) *string
+}{
+	{"Signature", func(i *Inspection) *string { return &i.Signature }},
+	{"Init signature", func(i *Inspection) *string { return &i.Signature }},
+	{"Call signature", func(i *Inspection) *string { return &i.Signature }},
+	{"Docstring", func(i *Inspection) *string { return &i.Docstring }},
+	{"Class docstring", func(i *Inspection) *string { return &i.Docstring }},
+	{"Init docstring", func(i *Inspection) *string { return &i.Docstring }},
+	{"Source", func(i *Inspection) *string { return &i.Source }},
+	{"Type", func(i *Inspection) *string { return &i.Type }},
+}
+
+// inspectHeading matches a heading line of an IPython object description
+var inspectHeading = regexp.MustCompile(`^(Signature|Init signature|Call signature|Docstring|Class docstring|Init docstring|Call docstring|Source|File|Type|String form|Length|Namespace|Subclasses|Repr):(?:\s+(.*))?$`)
+
+func (k *jupyterKernel) Inspect(ctx context.Context, code string, cursor int, detailLevel int) (*Inspection, error) {
+	reply, err := k.Kernel.Inspect(ctx, code, cursor, detailLevel)
+	if errors.Is(err, jupyter.ErrKernelDied) {
+		return nil, kernelDied(k.ProcessState())
+	}
+	if err != nil {
+		return nil, err
+	}
+	var content struct {
+		Status string                 `json:"status"`
+		Ename  string                 `json:"ename"`
+		Evalue string                 `json:"evalue"`
+		Found  bool                   `json:"found"`
+		Data   map[string]interface{} `json:"data"`
+	}
+	if err := reply.DecodeContent(&content); err != nil {
+		return nil, fmt.Errorf("invalid inspect_reply: %w", err)
+	}
+	if content.Status != "ok" {
+		return nil, fmt.Errorf("%s: %s", content.Ename, content.Evalue)
+	}
+	inspection := &Inspection{Found: content.Found}
+	text, _ := content.Data["text/plain"].(string)
+	inspection.Text = ansiEscape.ReplaceAllString(text, "")
+
+	// Split the description into its sections; kernels other than IPython's get Text only
+	sections := map[string][]string{}
+	var current string
+	for _, line := range strings.Split(inspection.Text, "\n") {
+		if m := inspectHeading.FindStringSubmatch(line); m != nil {
+			current = m[1]
+			if m[2] != "" {
+				sections[current] = append(sections[current], m[2])
+			}
+			continue
+		}
+		if current != "" {
+			sections[current] = append(sections[current], line)
+		}
+	}
+	for _, section := range inspectSections {
+		field := section.field(inspection)
+		if lines, ok := sections[section.heading]; ok && *field == "" {
+			*field = strings.TrimSpace(strings.Join(lines, "\n"))
+		}
+	}
+	if inspection.Docstring == "<no docstring>" {
+		inspection.Docstring = ""
+	}
+	return inspection, nil
+}
+
+// inspect answers an inspector request in a Python kernel by evaluating inspector.py's
+// inspection_result as a user expression. The inspector is loaded into a namespace of its own,
+// so nothing is left behind in the user's.
+func (k *jupyterKernel) inspect(ctx context.Context, req kernelRequest) (KernelEvent, error) {
+	if language := k.Spec().Language; language != "python" {
+		return KernelEvent{}, fmt.Errorf("the %s kernel has no variable inspector", language)
+	}
+	request, err := json.Marshal(req)
+	if err != nil {
+		return KernelEvent{}, err
+	}
+	// JSON strings are valid Python string literals
+	source, _ := json.Marshal(inspectorSource)
+	literal, _ := json.Marshal(string(request))
+	expression := fmt.Sprintf(`(lambda ns: exec(%s, ns) or ns["inspection_result"](globals(), ns["json"].loads(%s)))({"__name__": "pysync_inspector"})`, source, literal)
+
+	reply, err := k.Evaluate(ctx, map[string]string{"reply": expression})
+	if errors.Is(err, jupyter.ErrKernelDied) {
+		return KernelEvent{}, kernelDied(k.ProcessState())
+	}
+	if err != nil {
+		return KernelEvent{}, err
+	}
+	var content struct {
+		UserExpressions map[string]struct {
+			Status string                 `json:"status"`
+			Ename  string                 `json:"ename"`
+			Evalue string                 `json:"evalue"`
+			Data   map[string]interface{} `json:"data"`
+		} `json:"user_expressions"`
+	}
+	if err := reply.DecodeContent(&content); err != nil {
+		return KernelEvent{}, fmt.Errorf("invalid execute_reply: %w", err)
+	}
+	result, ok := content.UserExpressions["reply"]
+	if !ok {
+		return KernelEvent{}, errors.New("the kernel did not evaluate the inspector")
+	}
+	if result.Status != "ok" {
+		return KernelEvent{}, fmt.Errorf("%s: %s", result.Ename, result.Evalue)
+	}
+	text, _ := result.Data["text/plain"].(string)
+	var event KernelEvent
+	if err := json.Unmarshal([]byte(text), &event); err != nil {
+		return KernelEvent{}, fmt.Errorf("invalid inspector reply: %w", err)
+	}
+	return event, event.err()
+}
+
+// Debug is not supported: cells of Jupyter kernels are compiled under names of the kernel's
+// choosing, which the debug bridge cannot set breakpoints in
+func (k *jupyterKernel) Debug(ctx context.Context, cellDir string) (string, error) {
+	return "", fmt.Errorf("the debugger needs the built-in kernel, not the %s Jupyter kernel", k.Spec().Name)
+}
+
+func (k *jupyterKernel) Input(value string) error {
+	k.inputMu.Lock()
+	request := k.inputRequest
+	k.inputRequest = nil
+	k.inputMu.Unlock()
+	if request == nil {
+		return errors.New("the kernel is not waiting for input")
+	}
+	return k.InputReply(request, value)
+}
+
+// Signal interrupts the kernel the way its kernelspec asks for, or kills it
+func (k *jupyterKernel) Signal(sig syscall.Signal) error {
+	if sig == syscall.SIGINT {
+		return k.Interrupt()
+	}
+	return syscall.Kill(-k.Pid(), sig)
+}
+
+func (k *jupyterKernel) ExceededLimit() string {
+	return k.limits.exceeded(k.ProcessState())
+}
+
+func (k *jupyterKernel) Death() *KernelDeath {
+	if k.Alive() {
+		return nil
+	}
+	return k.exit.explain(k.ProcessState(), k.limits)
+}
+
+func (k *jupyterKernel) Close() {
+	k.Kernel.Close()
+	k.limits.release()
+	os.RemoveAll(k.dir)
+}
@@ -0,0 +1,500 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+//go:embed kernel.py
+var kernelSource string
+
+//go:embed inspector.py
+var inspectorSource string
+
+//go:embed magics.py
+var magicsSource string
+
+const kernelShutdownGrace = 2 * time.Second
+
+// ErrKernelDied is returned when the kernel process exits while a request is in flight
+var ErrKernelDied = errors.New("kernel died")
+
+// KernelDiedError is the ErrKernelDied of a kernel whose exit status is known
+type KernelDiedError struct {
+	// ExitCode is the kernel's exit status, or 128 plus the signal that killed it, as a shell
+	// reports it
+	ExitCode int
+	Signal   syscall.Signal
+}
+
+func (e *KernelDiedError) Error() string {
+	if e.Signal != 0 {
+		return fmt.Sprintf("kernel died: %v", e.Signal)
+	}
+	return fmt.Sprintf("kernel died with exit code %d", e.ExitCode)
+}
+
+func (e *KernelDiedError) Is(target error) bool {
+	return target == ErrKernelDied
+}
+
+// kernelDied describes the exit of a kernel process, which must have been waited for
+func kernelDied(state *os.ProcessState) error {
+	if state == nil {
+		return ErrKernelDied
+	}
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return &KernelDiedError{ExitCode: 128 + int(status.Signal()), Signal: status.Signal()}
+	}
+	return &KernelDiedError{ExitCode: state.ExitCode()}
+}
+
+// Kernel runs the cells of a session in one long-lived process. PythonKernel is the built-in
+// implementation; jupyterKernel drives any installed Jupyter kernel instead.
+type Kernel interface {
+	// Execute runs code, passing every event it produces to onEvent, and returns the final
+	// execute_reply. onEvent is never called concurrently.
+	Execute(ctx context.Context, code string, options ExecuteOptions, onEvent func(KernelEvent)) (KernelEvent, error)
+	// Variables lists the user-visible globals of the kernel's namespace, and Variable returns
+	// limit rows from offset on of the detailed view of one of them. Neither runs a cell.
+	Variables(ctx context.Context) ([]VariableSummary, error)
+	Variable(ctx context.Context, name string, offset, limit int) (*VariableDetail, error)
+	// Complete returns the completions at cursor, a character offset into code, and Inspect
+	// describes the object named there, both from the live namespace
+	Complete(ctx context.Context, code string, cursor int) (*Completion, error)
+	Inspect(ctx context.Context, code string, cursor int, detailLevel int) (*Inspection, error)
+	// Debug starts a Debug Adapter Protocol server attached to the kernel and returns its
+	// host:port. From then on cells run from files in cellDir, named by debugCellFile.
+	Debug(ctx context.Context, cellDir string) (string, error)
+	// Signal delivers SIGINT (interrupt the running cell) or SIGKILL to the kernel
+	Signal(sig syscall.Signal) error
+	// Input answers the input_request the running cell is blocked on
+	Input(value string) error
+	Alive() bool
+	// Done is closed once the kernel process has exited
+	Done() <-chan struct{}
+	// ExceededLimit names the resource limit (see ResourceLimits) the kernel ran into since it
+	// was last asked, or returns ""
+	ExceededLimit() string
+	// Death explains why the kernel process exited, or returns nil while it runs
+	Death() *KernelDeath
+	Kill()
+	Close()
+}
+
+// KernelEvent is a single message emitted by a kernel while it serves a request
+type KernelEvent struct {
+	Type   string `json:"type"`
+	MsgID  string `json:"msg_id"`
+	Name   string `json:"name,omitempty"`
+	Text   string `json:"text,omitempty"`
+	Status string `json:"status,omitempty"`
+	// Data and Metadata carry the MIME bundle of display_data and execute_result events
+	Data     map[string]interface{} `json:"data,omitempty"`
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+	// Ename, Evalue and Errno identify the exception of a failed reply, and Traceback
+	// lists where it was raised, innermost frame last
+	Ename     string           `json:"ename,omitempty"`
+	Evalue    string           `json:"evalue,omitempty"`
+	Errno     int              `json:"errno,omitempty"`
+	Traceback []TracebackFrame `json:"traceback,omitempty"`
+	// ExitCode is the status a cell that raised SystemExit asked for
+	ExitCode *int `json:"exit_code,omitempty"`
+	// CPUTime (seconds) and PeakRSS (bytes) are what an execute_reply's cell used, where the
+	// kernel measures it
+	CPUTime float64 `json:"cpu_time,omitempty"`
+	PeakRSS int64   `json:"peak_rss,omitempty"`
+	// Profile is the report of an execute_reply to a profiled request
+	Profile *ProfileReport `json:"profile,omitempty"`
+	// Prompt and Password describe an input_request event, sent when the cell reads stdin
+	Prompt   string `json:"prompt,omitempty"`
+	Password bool   `json:"password,omitempty"`
+	// Variables and Variable answer the variables and variable requests of the inspector
+	Variables []VariableSummary `json:"variables,omitempty"`
+	Variable  *VariableDetail   `json:"variable,omitempty"`
+	// Completion and Inspection answer the editor's complete and inspect requests
+	Completion *Completion `json:"completion,omitempty"`
+	Inspection *Inspection `json:"inspection,omitempty"`
+	// Address is where the debug adapter of a debug_reply listens
+	Address string `json:"address,omitempty"`
+}
+
+// err returns the error of a failed inspection reply, or nil
+func (e KernelEvent) err() error {
+	if e.Status != "error" {
+		return nil
+	}
+	return fmt.Errorf("%s: %s", e.Ename, e.Evalue)
+}
+
+// TracebackFrame is one entry of a Python traceback
+type TracebackFrame struct {
+	Filename string `json:"filename"`
+	Lineno   int    `json:"lineno"`
+	// Name is the function, or "<module>" for the top level of the cell
+	Name string `json:"name"`
+	Line string `json:"line"`
+}
+
+type kernelRequest struct {
+	Type  string `json:"type"`
+	MsgID string `json:"msg_id"`
+	Code  string `json:"code,omitempty"`
+	Value string `json:"value,omitempty"`
+	// Profile and ProfileMemory ask an execute request for a profile report
+	Profile       bool `json:"profile,omitempty"`
+	ProfileMemory bool `json:"profile_memory,omitempty"`
+	// Name, Offset and Limit select the page of a variable request
+	Name   string `json:"name,omitempty"`
+	Offset int    `json:"offset,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+	// CursorPos and DetailLevel go with the code of a complete or inspect request
+	CursorPos   int `json:"cursor_pos,omitempty"`
+	DetailLevel int `json:"detail_level,omitempty"`
+	// CellDir is the directory of the cell files of a debug request
+	CellDir string `json:"cell_dir,omitempty"`
+}
+
+// PythonKernel is a long-lived Python process, running kernel.py, that executes cells in a
+// shared namespace
+type PythonKernel struct {
+	cmd      *exec.Cmd
+	limits   *processLimits
+	exit     *exitDiagnosis
+	requests *os.File
+	done     chan struct{}
+	waitErr  error
+
+	// mu serializes requests; the kernel handles one at a time
+	mu     sync.Mutex
+	nextID atomic.Uint64
+	// writeMu keeps input replies from interleaving with requests on the pipe
+	writeMu sync.Mutex
+
+	// dispatchMu guards pending and serializes event delivery to it
+	dispatchMu sync.Mutex
+	pending    *pendingRequest
+}
+
+// pendingRequest routes the events of the request currently being served by the kernel
+type pendingRequest struct {
+	msgID   string
+	onEvent func(KernelEvent)
+	reply   chan KernelEvent
+}
+
+// StartPythonKernel launches a new built-in kernel using the given Python interpreter
+func StartPythonKernel(pythonPath string, options ProcessOptions) (*PythonKernel, error) {
+	// fd 3 carries requests into the kernel, fd 4 carries events back out
+	reqR, reqW, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("error creating request pipe: %w", err)
+	}
+	evR, evW, err := os.Pipe()
+	if err != nil {
+		return nil, closeAll(fmt.Errorf("error creating event pipe: %w", err), reqR, reqW)
+	}
+
+	// stdout and stderr use plain pipes rather than cmd.StdoutPipe so that
+	// cmd.Wait does not close them under the readers
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		return nil, closeAll(err, reqR, reqW, evR, evW)
+	}
+	errR, errW, err := os.Pipe()
+	if err != nil {
+		return nil, closeAll(err, reqR, reqW, evR, evW, outR, outW)
+	}
+
+	cmd := exec.Command(pythonPath, "-c", inspectorSource+magicsSource+kernelSource)
+	cmd.Dir = options.Workdir
+	cmd.Stdout = outW
+	cmd.Stderr = errW
+	cmd.ExtraFiles = []*os.File{reqR, evW}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	limited, err := confine(cmd, options)
+	if err != nil {
+		return nil, closeAll(err, reqR, reqW, evR, evW, outR, outW, errR, errW)
+	}
+
+	exit := newExitDiagnosis()
+	if err := cmd.Start(); err != nil {
+		limited.release()
+		return nil, closeAll(fmt.Errorf("error starting kernel: %w", err), reqR, reqW, evR, evW, outR, outW, errR, errW)
+	}
+	// The child holds its own copies of these ends now
+	reqR.Close()
+	evW.Close()
+	outW.Close()
+	errW.Close()
+
+	k := &PythonKernel{
+		cmd:      cmd,
+		limits:   limited,
+		exit:     exit,
+		requests: reqW,
+		done:     make(chan struct{}),
+	}
+
+	go k.readRawStream(outR, "stdout")
+	go k.readRawStream(errR, "stderr")
+	go func() {
+		// The event pipe is not inherited by anything the kernel spawns,
+		// so EOF on it means the kernel process itself has gone away
+		k.readEvents(evR)
+		evR.Close()
+		k.waitErr = cmd.Wait()
+		close(k.done)
+		log.Printf("Kernel %d exited: %v", cmd.Process.Pid, k.waitErr)
+	}()
+
+	log.Printf("Started kernel %d with %s", cmd.Process.Pid, pythonPath)
+	return k, nil
+}
+
+func closeAll(err error, files ...*os.File) error {
+	for _, f := range files {
+		f.Close()
+	}
+	return err
+}
+
+// readEvents decodes the JSON lines the kernel writes on its event pipe. Lines have no size
+// limit: a display bundle, unlike a stream, comes in one piece however large its image is.
+func (k *PythonKernel) readEvents(r io.Reader) {
+	reader := bufio.NewReaderSize(r, 64*1024)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var event KernelEvent
+			if err := json.Unmarshal(line, &event); err != nil {
+				log.Printf("Error decoding kernel event: %v", err)
+			} else {
+				k.dispatch(event)
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Error reading kernel events: %v", err)
+			}
+			return
+		}
+	}
+}
+
+// readRawStream forwards output written straight to the process file descriptors,
+// e.g. by C extensions or child processes, as stream events for the current request
+func (k *PythonKernel) readRawStream(r io.ReadCloser, name string) {
+	defer r.Close()
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			k.dispatch(KernelEvent{Type: "stream", Name: name, Text: string(buf[:n])})
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// dispatch hands an event to the request it belongs to. Events that arrive while
+// nothing is pending, or that belong to an abandoned request, are dropped.
+func (k *PythonKernel) dispatch(event KernelEvent) {
+	k.dispatchMu.Lock()
+	defer k.dispatchMu.Unlock()
+
+	p := k.pending
+	if p == nil {
+		log.Printf("Dropping kernel %s event with no pending request", event.Type)
+		return
+	}
+	if event.MsgID != "" && event.MsgID != p.msgID {
+		return
+	}
+	if strings.HasSuffix(event.Type, "_reply") {
+		select {
+		case p.reply <- event:
+		default:
+		}
+		return
+	}
+	p.onEvent(event)
+}
+
+func (k *PythonKernel) setPending(p *pendingRequest) {
+	k.dispatchMu.Lock()
+	k.pending = p
+	k.dispatchMu.Unlock()
+}
+
+// Signal delivers sig to the kernel's process group, which includes anything a cell started
+func (k *PythonKernel) Signal(sig syscall.Signal) error {
+	return syscall.Kill(-k.cmd.Process.Pid, sig)
+}
+
+// Alive reports whether the kernel process is still running
+func (k *PythonKernel) Alive() bool {
+	select {
+	case <-k.done:
+		return false
+	default:
+		return true
+	}
+}
+
+func (k *PythonKernel) Done() <-chan struct{} {
+	return k.done
+}
+
+// Execute runs code in the kernel namespace
+func (k *PythonKernel) Execute(ctx context.Context, code string, options ExecuteOptions, onEvent func(KernelEvent)) (KernelEvent, error) {
+	req := kernelRequest{Type: "execute", Code: code, Profile: options.Profile, ProfileMemory: options.ProfileMemory}
+	return k.call(ctx, req, onEvent)
+}
+
+func (k *PythonKernel) Variables(ctx context.Context) ([]VariableSummary, error) {
+	reply, err := k.call(ctx, kernelRequest{Type: "variables"}, nil)
+	if err == nil {
+		err = reply.err()
+	}
+	return reply.Variables, err
+}
+
+func (k *PythonKernel) Variable(ctx context.Context, name string, offset, limit int) (*VariableDetail, error) {
+	reply, err := k.call(ctx, kernelRequest{Type: "variable", Name: name, Offset: offset, Limit: limit}, nil)
+	if err == nil {
+		err = reply.err()
+	}
+	return reply.Variable, err
+}
+
+func (k *PythonKernel) Complete(ctx context.Context, code string, cursor int) (*Completion, error) {
+	reply, err := k.call(ctx, kernelRequest{Type: "complete", Code: code, CursorPos: cursor}, nil)
+	if err == nil {
+		err = reply.err()
+	}
+	return reply.Completion, err
+}
+
+func (k *PythonKernel) Inspect(ctx context.Context, code string, cursor int, detailLevel int) (*Inspection, error) {
+	reply, err := k.call(ctx, kernelRequest{Type: "inspect", Code: code, CursorPos: cursor, DetailLevel: detailLevel}, nil)
+	if err == nil {
+		err = reply.err()
+	}
+	return reply.Inspection, err
+}
+
+func (k *PythonKernel) Debug(ctx context.Context, cellDir string) (string, error) {
+	reply, err := k.call(ctx, kernelRequest{Type: "debug", CellDir: cellDir}, nil)
+	if err == nil {
+		err = reply.err()
+	}
+	return reply.Address, err
+}
+
+// call sends req, passing the events it causes to onEvent, and waits for its reply
+func (k *PythonKernel) call(ctx context.Context, req kernelRequest, onEvent func(KernelEvent)) (KernelEvent, error) {
+	if onEvent == nil {
+		onEvent = func(KernelEvent) {}
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	p := &pendingRequest{
+		msgID:   strconv.FormatUint(k.nextID.Add(1), 10),
+		onEvent: onEvent,
+		reply:   make(chan KernelEvent, 1),
+	}
+	k.setPending(p)
+	defer k.setPending(nil)
+
+	req.MsgID = p.msgID
+	if err := k.send(req); err != nil {
+		return KernelEvent{}, err
+	}
+
+	select {
+	case reply := <-p.reply:
+		return reply, nil
+	case <-ctx.Done():
+		return KernelEvent{}, ctx.Err()
+	case <-k.done:
+		return KernelEvent{}, kernelDied(k.cmd.ProcessState)
+	}
+}
+
+func (k *PythonKernel) ExceededLimit() string {
+	var state *os.ProcessState
+	select {
+	case <-k.done:
+		state = k.cmd.ProcessState
+	default:
+	}
+	return k.limits.exceeded(state)
+}
+
+func (k *PythonKernel) Death() *KernelDeath {
+	if k.Alive() {
+		return nil
+	}
+	return k.exit.explain(k.cmd.ProcessState, k.limits)
+}
+
+// Input sends the reply to an input_request of the running cell
+func (k *PythonKernel) Input(value string) error {
+	k.dispatchMu.Lock()
+	p := k.pending
+	k.dispatchMu.Unlock()
+	if p == nil {
+		return errors.New("no cell is running")
+	}
+	return k.send(kernelRequest{Type: "input_reply", MsgID: p.msgID, Value: value})
+}
+
+func (k *PythonKernel) send(req kernelRequest) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("error encoding kernel request: %w", err)
+	}
+	k.writeMu.Lock()
+	defer k.writeMu.Unlock()
+	if _, err := k.requests.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("error writing to kernel: %w", err)
+	}
+	return nil
+}
+
+// Kill terminates the kernel and every process in its process group
+func (k *PythonKernel) Kill() {
+	if k.Alive() {
+		syscall.Kill(-k.cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+// Close asks the kernel to exit, killing it if it does not do so promptly
+func (k *PythonKernel) Close() {
+	k.requests.Close()
+	select {
+	case <-k.done:
+	case <-time.After(kernelShutdownGrace):
+		k.Kill()
+		<-k.done
+	}
+	k.limits.release()
+}
@@ -0,0 +1,701 @@
+# PySync Python kernel.
+#
+# The Go backend starts one of these per code socket session and keeps it
+# alive for the lifetime of the connection so that every cell runs in the
+# same namespace. Requests arrive as JSON lines on fd 3 and events are
+# written back as JSON lines on fd 4, which leaves stdout and stderr free
+# for the code running inside the kernel.
+#
+# inspector.py is prepended to this file. It answers the variable
+# inspector's, completion and documentation requests. magics.py is prepended
+# too, and handles IPython's magics. A debug request starts debugpy in the
+# kernel for the server's debug bridge.
+
+import ast
+import base64
+import builtins
+import cProfile
+import getpass
+import hashlib
+import importlib.abc
+import io
+import json
+import linecache
+import os
+import pstats
+import resource
+import signal
+import socket
+import sys
+import threading
+import time
+import tracemalloc
+import traceback
+import types
+
+REQUEST_FD = 3
+EVENT_FD = 4
+# Partial lines (progress bars, print(..., end="")) are pushed out at least this often.
+FLUSH_INTERVAL = 0.1
+# Longest text in one stream event, in characters, so that printing a huge object reaches the
+# client in pieces instead of one event the server holds in memory whole.
+STREAM_CHUNK = 64 * 1024
+# Functions and allocation sites a profile report lists, and the frames kept per allocation.
+PROFILE_FUNCTIONS = 30
+PROFILE_ALLOCATIONS = 15
+TRACEMALLOC_FRAMES = 1
+# Oldest debugpy with an in-process debug adapter, and how long to wait for the adapter to
+# start listening.
+DEBUGPY_MINIMUM = (1, 8)
+DEBUGPY_LISTEN_TIMEOUT = 5
+# Name of the matplotlib backend module that turns figures into display_data events.
+MATPLOTLIB_BACKEND = "pysync_inline"
+
+# Rich representations looked up on displayed objects, following IPython's _repr_*_ protocol.
+MIME_REPRS = [
+    ("text/html", "_repr_html_"),
+    ("text/markdown", "_repr_markdown_"),
+    ("text/latex", "_repr_latex_"),
+    ("image/svg+xml", "_repr_svg_"),
+    ("image/png", "_repr_png_"),
+    ("image/jpeg", "_repr_jpeg_"),
+    ("application/json", "_repr_json_"),
+]
+BINARY_MIMES = ("image/png", "image/jpeg")
+
+
+class EventChannel:
+    """Serializes kernel events onto the event pipe."""
+
+    def __init__(self, fd):
+        self._file = os.fdopen(fd, "w", encoding="utf-8", buffering=1)
+        self._lock = threading.Lock()
+
+    def send(self, event):
+        line = json.dumps(event, default=str)
+        with self._lock:
+            self._file.write(line + "\n")
+            self._file.flush()
+
+
+class StreamWriter(io.TextIOBase):
+    """Replaces sys.stdout/sys.stderr and forwards writes as stream events."""
+
+    def __init__(self, kernel, name):
+        self._kernel = kernel
+        self._name = name
+        self._buffer = []
+        self._lock = threading.Lock()
+
+    @property
+    def encoding(self):
+        return "utf-8"
+
+    def writable(self):
+        return True
+
+    def isatty(self):
+        return False
+
+    def write(self, text):
+        if not isinstance(text, str):
+            raise TypeError("write() argument must be str, not %s" % type(text).__name__)
+        with self._lock:
+            self._buffer.append(text)
+        if "\n" in text or "\r" in text:
+            self.flush()
+        return len(text)
+
+    def flush(self):
+        with self._lock:
+            text = "".join(self._buffer)
+            self._buffer = []
+        if text:
+            self._kernel.send_stream(self._name, text)
+
+
+def format_bundle(obj):
+    """Returns the MIME bundle and metadata for obj, base64-encoding binary formats."""
+    data, metadata = {}, {}
+    instance = not isinstance(obj, type)
+
+    method = getattr(obj, "_repr_mimebundle_", None)
+    if instance and callable(method):
+        try:
+            result = method(include=None, exclude=None)
+        except Exception:
+            result = None
+        if isinstance(result, tuple):
+            result, extra = result
+            metadata.update(extra or {})
+        if isinstance(result, dict):
+            data.update(result)
+
+    for mime, name in MIME_REPRS:
+        method = getattr(obj, name, None)
+        if mime in data or not instance or not callable(method):
+            continue
+        try:
+            value = method()
+        except Exception:
+            continue
+        if isinstance(value, tuple):
+            value, extra = value
+            if extra:
+                metadata[mime] = extra
+        if value is not None:
+            data[mime] = value
+
+    if "image/png" not in data and is_matplotlib_figure(obj):
+        buffer = io.BytesIO()
+        obj.savefig(buffer, format="png", bbox_inches="tight")
+        data["image/png"] = buffer.getvalue()
+
+    for mime in BINARY_MIMES:
+        if isinstance(data.get(mime), (bytes, bytearray)):
+            data[mime] = base64.b64encode(data[mime]).decode("ascii")
+    if "text/plain" not in data:
+        try:
+            data["text/plain"] = repr(obj)
+        except Exception as err:
+            data["text/plain"] = "<unrepresentable %s: %s>" % (type(obj).__name__, err)
+    return data, metadata
+
+
+def is_matplotlib_figure(obj):
+    return type(obj).__module__.startswith("matplotlib.") and type(obj).__name__ == "Figure"
+
+
+class ImportPatcher(importlib.abc.MetaPathFinder):
+    """Runs a patch function on selected modules right after they are first imported."""
+
+    def __init__(self, patches):
+        self.patches = patches
+
+    def find_spec(self, fullname, path, target=None):
+        patch = self.patches.get(fullname)
+        if patch is None:
+            return None
+        for finder in sys.meta_path:
+            if finder is self or not hasattr(finder, "find_spec"):
+                continue
+            spec = finder.find_spec(fullname, path, target)
+            if spec is not None:
+                break
+        else:
+            return None
+        if spec.loader is None or not hasattr(spec.loader, "exec_module"):
+            return spec
+        exec_module = spec.loader.exec_module
+
+        def exec_and_patch(module):
+            exec_module(module)
+            patch(module)
+
+        spec.loader.exec_module = exec_and_patch
+        return spec
+
+
+class StdinReader(io.TextIOBase):
+    """Replaces sys.stdin and asks the client for every line that is read."""
+
+    def __init__(self, kernel):
+        self._kernel = kernel
+
+    def readable(self):
+        return True
+
+    def readline(self, size=-1):
+        return self._kernel.request_input("", False) + "\n"
+
+    def read(self, size=-1):
+        return self.readline()
+
+
+def cpu_time():
+    """CPU seconds used by the kernel and the child processes it has waited for."""
+    times = os.times()
+    return times.user + times.system + times.children_user + times.children_system
+
+
+def reset_peak_rss():
+    # Linux resets the process's peak RSS (VmHWM) on request, which makes it per cell.
+    try:
+        with open("/proc/self/clear_refs", "w") as f:
+            f.write("5")
+    except OSError:
+        pass
+
+
+def peak_rss():
+    """Peak resident set size in bytes, since the last reset_peak_rss where supported."""
+    try:
+        with open("/proc/self/status") as f:
+            for line in f:
+                if line.startswith("VmHWM:"):
+                    return int(line.split()[1]) * 1024
+    except (OSError, ValueError):
+        pass
+    # ru_maxrss is the peak over the kernel's lifetime, in bytes on macOS and KiB elsewhere
+    maxrss = resource.getrusage(resource.RUSAGE_SELF).ru_maxrss
+    return maxrss if sys.platform == "darwin" else maxrss * 1024
+
+
+class CellProfiler:
+    """Runs cell code under cProfile and, for memory profiles, tracemalloc, and
+    reports the functions that took the most time and the lines that allocated most."""
+
+    def __init__(self, memory):
+        self.profile = cProfile.Profile()
+        self.memory = memory
+        # A cell that traces allocations itself keeps tracing afterwards
+        self.started_tracing = False
+        self.snapshot = None
+        self.peak = 0
+
+    def start(self):
+        if self.memory:
+            if not tracemalloc.is_tracing():
+                tracemalloc.start(TRACEMALLOC_FRAMES)
+                self.started_tracing = True
+            elif hasattr(tracemalloc, "reset_peak"):
+                tracemalloc.reset_peak()
+        self.profile.enable()
+
+    def stop(self):
+        # The caller disables the profile itself; a call to this method would be profiled
+        if self.memory and tracemalloc.is_tracing():
+            self.peak = tracemalloc.get_traced_memory()[1]
+            self.snapshot = tracemalloc.take_snapshot()
+            if self.started_tracing:
+                tracemalloc.stop()
+
+    def report(self):
+        stats = pstats.Stats(self.profile).stats
+        functions = []
+        for (filename, lineno, name), (primitive, calls, own, cumulative, callers) in stats.items():
+            # Builtins nothing in the cell called are the kernel's exec, eval and the
+            # profiler's own disable
+            if filename == "~" and not callers:
+                continue
+            functions.append({
+                "function": name,
+                "filename": "" if filename == "~" else filename,
+                "lineno": lineno,
+                "calls": calls,
+                "primitive_calls": primitive,
+                "total_time": own,
+                "cumulative_time": cumulative,
+            })
+        report = {
+            "total_time": sum(f["total_time"] for f in functions),
+            "total_calls": sum(f["calls"] for f in functions),
+        }
+        functions.sort(key=lambda f: f["cumulative_time"], reverse=True)
+        report["functions"] = functions[:PROFILE_FUNCTIONS]
+
+        if self.snapshot is not None:
+            snapshot = self.snapshot.filter_traces([
+                tracemalloc.Filter(False, tracemalloc.__file__),
+                tracemalloc.Filter(False, KERNEL_FILENAME),
+            ])
+            statistics = snapshot.statistics("lineno")
+            sites = []
+            for stat in statistics[:PROFILE_ALLOCATIONS]:
+                frame = stat.traceback[0]
+                sites.append({
+                    "filename": frame.filename,
+                    "lineno": frame.lineno,
+                    "line": linecache.getline(frame.filename, frame.lineno).strip(),
+                    "size": stat.size,
+                    "count": stat.count,
+                })
+            report["memory"] = {
+                "peak": self.peak,
+                "allocated": sum(stat.size for stat in statistics),
+                "sites": sites,
+            }
+        return report
+
+
+def debugpy_version(version):
+    """The leading numbers of a version string as a tuple: "1.8.7" is (1, 8, 7)."""
+    release = []
+    for part in version.split("."):
+        if not part.isdigit():
+            break
+        release.append(int(part))
+    return tuple(release)
+
+
+def listen_debugpy(path):
+    """Starts debugpy's debug adapter in this process, listening on a unix socket at path that
+    only this user can connect to, and returns path. debugpy itself only listens on TCP ports,
+    which any local user could connect to, and which the server cannot reach in a sandbox
+    without network access."""
+    import inspect
+
+    import debugpy
+    import debugpy.server.api  # puts debugpy's own copy of pydevd on sys.path
+    import pydevd
+
+    # The in-process adapter is pydevd, which makes its listening socket with
+    # create_server_socket in a thread of its own. That function is not part of debugpy's API,
+    # so the release and the function are checked before it is replaced, and the replacement
+    # must be called, for a clear error rather than a debugger that never attaches.
+    version = getattr(debugpy, "__version__", "unknown")
+    minimum = ".".join(map(str, DEBUGPY_MINIMUM))
+
+    def unsupported(reason):
+        return RuntimeError("the debugger does not support debugpy %s (%s); it was made for "
+                            "debugpy %s" % (version, reason, minimum))
+
+    if debugpy_version(version) < DEBUGPY_MINIMUM:
+        raise unsupported("no in-process debug adapter")
+    original = getattr(pydevd, "create_server_socket", None)
+    try:
+        parameters = list(inspect.signature(original).parameters)
+    except (TypeError, ValueError):
+        parameters = None
+    if parameters != ["host", "port"]:
+        raise unsupported("pydevd.create_server_socket has changed")
+
+    # Binding the socket here lets errors reach the caller and has the socket accept
+    # connections by the time the server dials it
+    server = socket.socket(socket.AF_UNIX, socket.SOCK_STREAM)
+    try:
+        if os.path.exists(path):
+            os.unlink(path)
+        server.bind(path)
+        # The directory is the user's alone already
+        os.chmod(path, 0o600)
+        server.listen(1)
+    except Exception:
+        server.close()
+        raise
+    used = threading.Event()
+
+    def create_server_socket(host, port):
+        used.set()
+        return server
+
+    pydevd.create_server_socket = create_server_socket
+    try:
+        debugpy.listen(("127.0.0.1", 0), in_process_debug_adapter=True)
+        if not used.wait(DEBUGPY_LISTEN_TIMEOUT):
+            raise unsupported("the adapter did not take the kernel's socket")
+    except Exception:
+        server.close()
+        os.unlink(path)
+        raise
+    finally:
+        pydevd.create_server_socket = original
+    return path
+
+
+class Kernel:
+    def __init__(self):
+        self.events = EventChannel(EVENT_FD)
+        self.requests = os.fdopen(REQUEST_FD, "r", encoding="utf-8")
+        self.msg_id = ""
+        # Cells run in a fresh __main__ module so that pickling, dataclasses
+        # and friends resolve user-defined names the way they would in a script.
+        main_module = types.ModuleType("__main__")
+        main_module.__dict__["__builtins__"] = builtins
+        sys.modules["__main__"] = main_module
+        self.namespace = main_module.__dict__
+        self.stdout = StreamWriter(self, "stdout")
+        self.stderr = StreamWriter(self, "stderr")
+        self.stdin = StdinReader(self)
+        self.cell_count = 0
+        # Once a debugger is attached, cells are saved to files in cell_dir so that
+        # breakpoints can be set in them; debug_address is debugpy's socket.
+        self.cell_dir = None
+        self.debug_address = None
+
+    def send(self, event):
+        if "msg_id" not in event:
+            event["msg_id"] = self.msg_id
+        self.events.send(event)
+
+    def send_stream(self, name, text):
+        for start in range(0, len(text), STREAM_CHUNK):
+            self.send({"type": "stream", "name": name, "text": text[start:start + STREAM_CHUNK]})
+
+    def flush_streams(self):
+        self.stdout.flush()
+        self.stderr.flush()
+
+    def flush_periodically(self):
+        while True:
+            time.sleep(FLUSH_INTERVAL)
+            self.flush_streams()
+
+    def request_input(self, prompt, password):
+        """Sends an input_request and blocks until the client's input_reply arrives."""
+        self.flush_streams()
+        self.send({"type": "input_request", "prompt": prompt, "password": password})
+        # The server sends nothing but the reply while a cell runs, so it can be read
+        # straight off the request channel.
+        while True:
+            line = self.requests.readline()
+            if not line:
+                raise EOFError("input channel closed")
+            try:
+                request = json.loads(line)
+            except ValueError:
+                continue
+            if request.get("type") == "input_reply":
+                return request.get("value", "")
+
+    def install_input_hooks(self):
+        def input(prompt=""):
+            return self.request_input(str(prompt), False)
+
+        def getpass_(prompt="Password: ", stream=None):
+            return self.request_input(str(prompt), True)
+
+        builtins.input = input
+        getpass.getpass = getpass_
+
+    def display(self, obj, kind="display_data", raw=False, metadata=None):
+        if raw:
+            data, extra = dict(obj), {}
+        else:
+            data, extra = format_bundle(obj)
+        extra.update(metadata or {})
+        # Stream output printed before the display has to reach the client first.
+        self.flush_streams()
+        self.send({"type": kind, "data": data, "metadata": extra})
+
+    def display_function(self):
+        """Builds a display() compatible with IPython.display.display."""
+
+        def display(*objs, raw=False, metadata=None, **kwargs):
+            for obj in objs:
+                self.display(obj, raw=raw, metadata=metadata)
+
+        return display
+
+    def install_magics(self):
+        setattr(builtins, MAGICS_NAME, Magics(self))
+
+    def install_display_hooks(self):
+        display = self.display_function()
+        builtins.display = display
+
+        def patch_display(module):
+            module.display = display
+
+        sys.meta_path.insert(0, ImportPatcher({
+            "IPython.core.display_functions": patch_display,
+            "IPython.core.display": patch_display,
+        }))
+
+        # plt.show() and figures left open at the end of a cell are rendered as PNGs
+        # through a backend module that reuses Agg for drawing.
+        backend = types.ModuleType(MATPLOTLIB_BACKEND)
+
+        def backend_getattr(name):
+            from matplotlib.backends import backend_agg
+            return getattr(backend_agg, name)
+
+        backend.__getattr__ = backend_getattr
+        backend.show = lambda *args, **kwargs: self.flush_figures()
+        sys.modules[MATPLOTLIB_BACKEND] = backend
+        os.environ.setdefault("MPLBACKEND", "module://" + MATPLOTLIB_BACKEND)
+
+    def flush_figures(self):
+        pyplot = sys.modules.get("matplotlib.pyplot")
+        if pyplot is None or MATPLOTLIB_BACKEND not in pyplot.get_backend():
+            return
+        for number in pyplot.get_fignums():
+            self.display(pyplot.figure(number))
+        pyplot.close("all")
+
+    def run_cell(self, source, profiler=None):
+        # Every cell gets a file name of its own, with its source in linecache, so that
+        # tracebacks show the lines of the cell that defined a function.
+        self.cell_count += 1
+        filename = self.cell_file(source) or "<cell-%d>" % self.cell_count
+        linecache.cache[filename] = (len(source), None, source.splitlines(True), filename)
+        try:
+            tree = ast.parse(transform_magics(source), filename=filename, mode="exec")
+        except SyntaxError as err:
+            # Without the frames of the parser, which are not the user's concern
+            raise err.with_traceback(None)
+        # Like a notebook, the value of a trailing expression is displayed unless
+        # the cell ends with a semicolon.
+        last = None
+        if tree.body and isinstance(tree.body[-1], ast.Expr) and not source.rstrip().endswith(";"):
+            last = ast.Expression(tree.body.pop().value)
+        body = compile(tree, filename, "exec")
+        if last is not None:
+            last = compile(last, filename, "eval")
+        value = None
+        if profiler is not None:
+            profiler.start()
+        try:
+            exec(body, self.namespace)
+            if last is not None:
+                value = eval(last, self.namespace)
+        finally:
+            if profiler is not None:
+                profiler.profile.disable()
+                profiler.stop()
+        if value is not None:
+            self.namespace["_"] = value
+            self.display(value, kind="execute_result")
+
+    def cell_file(self, source):
+        """Saves source to the debugger's cell file for it, named after its SHA-1 as the
+        server names it, and returns the file name, or None when not debugging."""
+        if self.cell_dir is None:
+            return None
+        data = source.encode("utf-8", "surrogatepass")
+        filename = os.path.join(self.cell_dir, "cell_%s.py" % hashlib.sha1(data).hexdigest()[:16])
+        if not os.path.exists(filename):
+            try:
+                with open(filename, "wb") as f:
+                    f.write(data)
+            except OSError:
+                pass
+        return filename
+
+    def debug(self, request):
+        """Starts debugpy listening on a unix socket in the requested directory, once, and from
+        now on runs cells from files in that directory."""
+        reply = {"type": "debug_reply", "status": "ok"}
+        try:
+            cell_dir = request.get("cell_dir") or None
+            if self.debug_address is None:
+                if cell_dir is None:
+                    raise ValueError("the debugger needs a cell directory")
+                self.debug_address = listen_debugpy(os.path.join(cell_dir, "debugpy.sock"))
+            self.cell_dir = cell_dir
+            reply["address"] = self.debug_address
+        except Exception as err:
+            reply.update(status="error", ename=type(err).__name__, evalue=str(err))
+        self.send(reply)
+
+    def execute(self, request):
+        reply = {"type": "execute_reply", "status": "ok"}
+        profiler = None
+        if request.get("profile"):
+            profiler = CellProfiler(request.get("profile_memory", False))
+        reset_peak_rss()
+        cpu_start = cpu_time()
+        try:
+            self.run_cell(request.get("code", ""), profiler)
+            self.flush_figures()
+        except BaseException as err:
+            if isinstance(err, SystemExit) and not err.code:
+                pass
+            else:
+                reply["status"] = "error"
+                reply["ename"] = type(err).__name__
+                reply["evalue"] = str(err)
+                if isinstance(err, OSError) and err.errno:
+                    reply["errno"] = err.errno
+                if isinstance(err, SystemExit):
+                    # sys.exit("message") exits with 1, like the interpreter does
+                    reply["exit_code"] = err.code if isinstance(err.code, int) else 1
+                reply["traceback"] = self.print_exception(err)
+        reply["cpu_time"] = cpu_time() - cpu_start
+        reply["peak_rss"] = peak_rss()
+        if profiler is not None:
+            try:
+                reply["profile"] = profiler.report()
+            except Exception as err:
+                self.stderr.write("Error reporting the profile: %s\n" % err)
+        self.flush_streams()
+        self.send(reply)
+
+    def inspect(self, request):
+        self.send(inspection_reply(self.namespace, request))
+
+    def print_exception(self, err):
+        """Print the traceback of err to stderr and return its frames, innermost last."""
+        # Drop the kernel's own frames (exec, input, display hooks) so the traceback
+        # only shows the cell and the code it called.
+        report = traceback.TracebackException(type(err), err, err.__traceback__)
+        current = report
+        while current is not None:
+            frames = [frame for frame in current.stack if frame.filename != KERNEL_FILENAME]
+            current.stack = traceback.StackSummary.from_list(frames)
+            current = current.__cause__ or current.__context__
+        self.stderr.write("".join(report.format()))
+
+        frames = [
+            {
+                "filename": frame.filename,
+                "lineno": frame.lineno,
+                "name": frame.name,
+                "line": frame.line or "",
+            }
+            for frame in report.stack
+        ]
+        if isinstance(err, SyntaxError) and err.lineno:
+            # The code that failed to compile has no frame of its own
+            frames.append({
+                "filename": err.filename or "",
+                "lineno": err.lineno,
+                "name": "",
+                "line": (err.text or "").strip(),
+            })
+        return frames
+
+    def serve(self):
+        handlers = {
+            "execute": self.execute,
+            "variables": self.inspect,
+            "variable": self.inspect,
+            "complete": self.inspect,
+            "inspect": self.inspect,
+            "debug": self.debug,
+            # A reply that arrives after its cell was interrupted has nobody to read it
+            "input_reply": lambda request: None,
+        }
+        while True:
+            try:
+                line = self.requests.readline()
+            except KeyboardInterrupt:
+                continue
+            if not line:
+                return
+            try:
+                request = json.loads(line)
+            except ValueError:
+                continue
+            self.msg_id = request.get("msg_id", "")
+            handler = handlers.get(request.get("type"))
+            try:
+                if handler is None:
+                    text = "unknown request type: %s" % request.get("type")
+                    self.send({"type": "error", "text": text})
+                else:
+                    handler(request)
+            except KeyboardInterrupt:
+                continue
+
+
+KERNEL_FILENAME = Kernel.execute.__code__.co_filename
+
+
+def main():
+    os.set_inheritable(REQUEST_FD, False)
+    os.set_inheritable(EVENT_FD, False)
+    signal.signal(signal.SIGINT, signal.default_int_handler)
+    kernel = Kernel()
+    sys.stdout = kernel.stdout
+    sys.stderr = kernel.stderr
+    sys.stdin = kernel.stdin
+    kernel.install_input_hooks()
+    kernel.install_display_hooks()
+    kernel.install_magics()
+    threading.Thread(target=kernel.flush_periodically, daemon=True).start()
+    kernel.serve()
+
+
+if __name__ == "__main__":
+    main()
@@ -0,0 +1,42 @@
+package api
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestReadEvents(t *testing.T) {
+	// Larger than any line limit the event pipe ever had
+	image := strings.Repeat("A", 3*1024*1024)
+	display, err := json.Marshal(KernelEvent{
+		Type:  "display_data",
+		MsgID: "cell",
+		Data:  map[string]interface{}{"image/png": image},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := string(display) + "\n" +
+		"not json\n" +
+		"\n" +
+		`{"type": "stream", "msg_id": "other", "name": "stdout", "text": "dropped"}` + "\n" +
+		`{"type": "stream", "msg_id": "cell", "name": "stdout", "text": "after"}`
+
+	var events []KernelEvent
+	k := &PythonKernel{}
+	k.setPending(&pendingRequest{msgID: "cell", onEvent: func(event KernelEvent) {
+		events = append(events, event)
+	}})
+	k.readEvents(strings.NewReader(input))
+
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want 2", len(events))
+	}
+	if events[0].Type != "display_data" || events[0].Data["image/png"] != image {
+		t.Errorf("got a %s event, want the display_data event with its image", events[0].Type)
+	}
+	if events[1].Type != "stream" || events[1].Text != "after" {
+		t.Errorf("got %+v, want the stream event after the display", events[1])
+	}
+}
@@ -0,0 +1,157 @@
+package api
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+)
+
+// LauncherArg is the first argument that makes the backend binary act as a launcher: it sets up
+// the sandbox and resource limits for itself and then execs the real command, so that they are
+// in place before the command's first instruction runs
+const LauncherArg = "__pysync_launch"
+
+// viaLauncher makes cmd, which must not have been started, run through the launcher with the
+// given flags. A command already going through the launcher gets the flags added, so limits and
+// the sandbox share one launcher. Without flags cmd is left alone.
+func viaLauncher(cmd *exec.Cmd, flags ...string) error {
+	if len(flags) == 0 {
+		return nil
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("cannot find the launcher: %w", err)
+	}
+	args := append([]string{self, LauncherArg}, flags...)
+	if cmd.Path == self && len(cmd.Args) > 1 && cmd.Args[1] == LauncherArg {
+		cmd.Args = append(args, cmd.Args[2:]...)
+		return nil
+	}
+	args = append(args, "--", cmd.Path)
+	cmd.Args = append(args, cmd.Args[1:]...)
+	cmd.Path = self
+	return nil
+}
+
+// stringList is a flag that may be given several times
+type stringList []string
+
+func (l *stringList) String() string {
+	return fmt.Sprint(*l)
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// Launch is the launcher's main function. It enters the sandbox and sets the rlimits given as
+// flags, then replaces itself with the command after "--". It only returns on error.
+func Launch(args []string) error {
+	flags := flag.NewFlagSet(LauncherArg, flag.ContinueOnError)
+	as := flags.Uint64("as", 0, "address space limit in bytes")
+	cpu := flags.Uint64("cpu", 0, "CPU time limit in seconds")
+	nofile := flags.Uint64("nofile", 0, "open file limit")
+	nproc := flags.Uint64("nproc", 0, "process limit")
+	var sandbox sandboxSpec
+	flags.BoolVar(&sandbox.enabled, "sandbox", false, "run in the sandbox the launcher was started in")
+	initProcess := flags.Bool("init", false, "stay in the sandbox as the init of the command")
+	flags.BoolVar(&sandbox.isolateNetwork, "isolate-network", false, "bring up loopback in the new network namespace")
+	flags.StringVar(&sandbox.workdir, "workdir", "", "working directory, mounted read-write")
+	flags.Var((*stringList)(&sandbox.readOnly), "ro", "host path to mount read-only")
+	flags.Var((*stringList)(&sandbox.readWrite), "rw", "host path to mount read-write")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	command := flags.Args()
+	if len(command) == 0 {
+		return fmt.Errorf("no command given")
+	}
+
+	if sandbox.enabled {
+		if err := enterSandbox(sandbox); err != nil {
+			return fmt.Errorf("cannot set up the sandbox: %w", err)
+		}
+	}
+
+	limits := []struct {
+		resource int
+		value    uint64
+		hard     uint64
+	}{
+		{syscall.RLIMIT_AS, *as, *as},
+		// The gap between the soft and hard limit lets the process see SIGXCPU first
+		{syscall.RLIMIT_CPU, *cpu, *cpu + 1},
+		{syscall.RLIMIT_NOFILE, *nofile, *nofile},
+		{rlimitNproc, *nproc, *nproc},
+	}
+	for _, limit := range limits {
+		if limit.value == 0 {
+			continue
+		}
+		// Raising a hard limit takes privileges the server usually lacks, and a limit above the
+		// server's own would not apply anyway, so requests are clamped to it
+		var current syscall.Rlimit
+		if err := syscall.Getrlimit(limit.resource, &current); err != nil {
+			return fmt.Errorf("getrlimit(%d): %w", limit.resource, err)
+		}
+		limit.hard = min(limit.hard, current.Max)
+		limit.value = min(limit.value, limit.hard)
+		if err := syscall.Setrlimit(limit.resource, &syscall.Rlimit{Cur: limit.value, Max: limit.hard}); err != nil {
+			return fmt.Errorf("setrlimit(%d): %w", limit.resource, err)
+		}
+	}
+	if sandbox.enabled && *initProcess {
+		return runInit(command)
+	}
+	return syscall.Exec(command[0], command, os.Environ())
+}
+
+// initSignals are the signals runInit passes on to the command
+var initSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2}
+
+// runInit is the launcher's main function as the first process of the sandbox's PID namespace.
+// The kernel drops every signal to that process it has no handler for, so a command exec'd in
+// its place, such as sh, could not be interrupted. runInit starts the command as its child
+// instead, in a process group of its own, passes initSignals on to that group and reaps the
+// orphans that get left to it. It exits with the command's exit status, or 128 plus the signal
+// that killed it, as a shell does.
+func runInit(command []string) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, initSignals...)
+	// The command is forked from this thread, the one that gave up its capabilities
+	child, err := os.StartProcess(command[0], command, &os.ProcAttr{
+		Env:   os.Environ(),
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
+		Sys:   &syscall.SysProcAttr{Setpgid: true},
+	})
+	if err != nil {
+		return err
+	}
+	go func() {
+		for sig := range signals {
+			syscall.Kill(-child.Pid, sig.(syscall.Signal))
+		}
+	}()
+
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &status, 0, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("waiting for the command: %w", err)
+		}
+		if pid != child.Pid {
+			continue
+		}
+		if status.Signaled() {
+			os.Exit(128 + int(status.Signal()))
+		}
+		os.Exit(status.ExitStatus())
+	}
+}
@@ -0,0 +1,135 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"syscall"
+)
+
+// The states of a session kernel, sent in kernel_status messages whenever they change
+const (
+	KernelStarting   = "starting"
+	KernelIdle       = "idle"
+	KernelBusy       = "busy"
+	KernelRestarting = "restarting"
+	// KernelDead is also the state of a session whose kernel has not been started yet
+	KernelDead = "dead"
+)
+
+// setKernelStatus records the state of the session kernel and tells the client when it
+// changed. detail, if any, says why, e.g. the error a kernel failed to start with.
+func (c *Client) setKernelStatus(status string, detail string) {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	if c.kernelStatus == status {
+		return
+	}
+	c.kernelStatus = status
+	// Sent under the lock so that the client sees the transitions in order
+	c.sendMessage(WebSocketMessage{Type: "kernel_status", Status: status, Content: detail})
+}
+
+func (c *Client) currentKernelStatus() string {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	if c.kernelStatus == "" {
+		return KernelDead
+	}
+	return c.kernelStatus
+}
+
+// watchKernel reports the kernel dead once its process exits, unless it was shut down or
+// replaced by then, which is reported where that happens. A kernel that died by itself is
+// restarted if the session's restart policy says so.
+func (c *Client) watchKernel(kernel Kernel) {
+	select {
+	case <-kernel.Done():
+	case <-c.done:
+		return
+	}
+	c.kernelMu.Lock()
+	defer c.kernelMu.Unlock()
+	if death := c.kernelExitedLocked(kernel); death != nil {
+		c.restartAfterDeathLocked(death)
+	}
+}
+
+// kernelFinished reports the kernel idle after a cell unless it went away meanwhile. A cell
+// that ran to the end also ends a series of automatic restarts.
+func (c *Client) kernelFinished(kernel Kernel) {
+	c.kernelMu.Lock()
+	current := c.kernel == kernel && kernel.Alive()
+	if current {
+		c.autoRestarts = 0
+	}
+	c.kernelMu.Unlock()
+	if current {
+		c.setKernelStatus(KernelIdle, "")
+	}
+}
+
+// closeKernelLocked shuts the session kernel down, if there is one, and reports it dead
+func (c *Client) closeKernelLocked() {
+	if c.kernel == nil {
+		return
+	}
+	kernel := c.kernel
+	c.kernel = nil
+	c.stoppedKernel = nil
+	kernel.Close()
+	c.setKernelStatus(KernelDead, "The kernel was shut down")
+}
+
+// stopCells kills the cells running in the session kernel, whose python_done then reports
+// them killed
+func (c *Client) stopCells() {
+	c.runningMu.Lock()
+	var cells []*execution
+	for e := range c.running {
+		if e.kind == "python" {
+			cells = append(cells, e)
+		}
+	}
+	c.runningMu.Unlock()
+	for _, e := range cells {
+		if err := e.signal(syscall.SIGKILL); err != nil {
+			log.Printf("Error killing python execution %s: %v", e.req.MsgID, err)
+		}
+	}
+}
+
+// restartKernel handles kernel_restart: the running cell, if any, is killed, the kernel is
+// replaced by a fresh one with an empty namespace, and the reply says whether it started
+func (c *Client) restartKernel(req WebSocketMessage) {
+	c.setKernelStatus(KernelRestarting, "")
+	c.stopCells()
+
+	c.kernelMu.Lock()
+	if c.kernel != nil {
+		kernel := c.kernel
+		c.kernel = nil
+		kernel.Close()
+	}
+	c.autoRestarts = 0
+	_, err := c.startKernelLocked()
+	c.kernelMu.Unlock()
+	if err != nil {
+		log.Printf("Error restarting kernel: %v", err)
+		c.sendDone(req, "kernel_restart_reply", "error", fmt.Sprintf("Error: %v", err))
+		return
+	}
+	c.sendDone(req, "kernel_restart_reply", "ok", "")
+}
+
+// shutdownKernelRequest handles kernel_shutdown: the running cell, if any, is killed along with
+// the kernel. The next cell starts a new kernel.
+func (c *Client) shutdownKernelRequest(req WebSocketMessage) {
+	c.stopCells()
+	c.shutdownKernel()
+	c.sendDone(req, "kernel_shutdown_reply", "ok", "")
+}
+
+// sendKernelStatus answers a kernel_status request with the kernel's current state
+func (c *Client) sendKernelStatus(req WebSocketMessage) {
+	c.reply(req, WebSocketMessage{Type: "kernel_status", Status: c.currentKernelStatus()})
+}
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"encoding/json"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// kernelClient returns a client for a test that runs the built-in kernel, and a channel with
+// the messages sent to it
+func kernelClient(t *testing.T) (*Client, <-chan WebSocketMessage) {
+	t.Helper()
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 is not installed")
+	}
+	c := &Client{send: make(chan []byte, 256), done: make(chan struct{}), queue: newExecutionQueue()}
+	c.restartPolicy = &RestartPolicy{When: RestartNever}
+	c.workdir = t.TempDir()
+	messages := make(chan WebSocketMessage, 256)
+	go func() {
+		for {
+			select {
+			case data := <-c.send:
+				var msg WebSocketMessage
+				if json.Unmarshal(data, &msg) == nil {
+					messages <- msg
+				}
+			case <-c.done:
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		c.shutdownKernel()
+		close(c.done)
+	})
+	return c, messages
+}
+
+// waitForMessage returns the first message of the given type, skipping the others, or the next
+// message of any type when msgType is ""
+func waitForMessage(t *testing.T, messages <-chan WebSocketMessage, msgType string) WebSocketMessage {
+	t.Helper()
+	timeout := time.After(20 * time.Second)
+	for {
+		select {
+		case msg := <-messages:
+			if msgType == "" || msg.Type == msgType {
+				return msg
+			}
+		case <-timeout:
+			t.Fatalf("no %s message", msgType)
+		}
+	}
+}
+
+func TestRestartThenCrash(t *testing.T) {
+	c, messages := kernelClient(t)
+
+	go c.executePythonCode(WebSocketMessage{Type: "python", MsgID: "sleep", Content: "import time\ntime.sleep(60)", Timeout: new(float64)})
+	for waitForMessage(t, messages, "kernel_status").Status != KernelBusy {
+	}
+
+	// The restart kills the running cell, which stops the old kernel
+	c.restartKernel(WebSocketMessage{Type: "kernel_restart", MsgID: "restart"})
+	replies := map[string]WebSocketMessage{}
+	for len(replies) < 2 {
+		msg := waitForMessage(t, messages, "")
+		if msg.Type == "kernel_restart_reply" || msg.Type == "python_done" {
+			replies[msg.Type] = msg
+		}
+	}
+	if reply := replies["kernel_restart_reply"]; reply.Status != "ok" {
+		t.Fatalf("got restart status %q: %s", reply.Status, reply.Content)
+	}
+	if done := replies["python_done"]; done.Status != "killed" {
+		t.Errorf("got python_done status %q, want killed", done.Status)
+	}
+
+	c.kernelMu.Lock()
+	kernel, stopped := c.kernel, c.stoppedKernel
+	c.kernelMu.Unlock()
+	if kernel == nil {
+		t.Fatal("no kernel after the restart")
+	}
+	if stopped != nil {
+		t.Errorf("the stopped kernel is still recorded after the restart")
+	}
+
+	// The new kernel crashing is a crash, not the stop of the old one
+	if err := kernel.Signal(syscall.SIGSEGV); err != nil {
+		t.Fatal(err)
+	}
+	died := waitForMessage(t, messages, "kernel_died")
+	if died.Status != DeathSignal || died.Signal != "SIGSEGV" {
+		t.Errorf("got kernel_died %q with signal %q, want %q with SIGSEGV", died.Status, died.Signal, DeathSignal)
+	}
+}
@@ -0,0 +1,297 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// ResourceLimits caps what the kernel and shell commands of a session may use. Zero means no
+// limit.
+type ResourceLimits struct {
+	// AddressSpace is a memory limit in bytes. It is enforced as memory.max when executions run
+	// in a cgroup, and as RLIMIT_AS (virtual address space) otherwise.
+	AddressSpace uint64 `json:"address_space,omitempty"`
+	// CPUSeconds is the CPU time a process may use (RLIMIT_CPU). The kernel is one process, so
+	// for cells this is a budget for the kernel's lifetime rather than per cell.
+	CPUSeconds uint64 `json:"cpu_seconds,omitempty"`
+	// OpenFiles caps the number of open file descriptors per process (RLIMIT_NOFILE)
+	OpenFiles uint64 `json:"open_files,omitempty"`
+	// Processes caps the processes a kernel or command may have running. It is enforced as
+	// pids.max in a cgroup, and as RLIMIT_NPROC otherwise, which counts every process of the
+	// user and does not apply to root.
+	Processes uint64 `json:"processes,omitempty"`
+}
+
+func (l ResourceLimits) isZero() bool {
+	return l == ResourceLimits{}
+}
+
+// within returns l with every limit the server sets capped at the server's value, so a session
+// can tighten the server's limits but not lift them
+func (l ResourceLimits) within(server ResourceLimits) ResourceLimits {
+	capAt := func(value uint64, max uint64) uint64 {
+		if max > 0 && (value == 0 || value > max) {
+			return max
+		}
+		return value
+	}
+	return ResourceLimits{
+		AddressSpace: capAt(l.AddressSpace, server.AddressSpace),
+		CPUSeconds:   capAt(l.CPUSeconds, server.CPUSeconds),
+		OpenFiles:    capAt(l.OpenFiles, server.OpenFiles),
+		Processes:    capAt(l.Processes, server.Processes),
+	}
+}
+
+// describe names a limit for messages to the client
+func (l ResourceLimits) describe(limit string) string {
+	switch limit {
+	case "address_space":
+		return fmt.Sprintf("memory limit of %s", formatSize(l.AddressSpace))
+	case "cpu_seconds":
+		return fmt.Sprintf("CPU time limit of %ds", l.CPUSeconds)
+	case "open_files":
+		return fmt.Sprintf("open file limit of %d", l.OpenFiles)
+	case "processes":
+		return fmt.Sprintf("process limit of %d", l.Processes)
+	}
+	return limit
+}
+
+// fromError maps the exception a cell failed with to the limit that most likely caused it.
+// Running out of address space, file descriptors or processes makes the failing call raise
+// rather than killing the kernel.
+func (l ResourceLimits) fromError(ename string, errno int) string {
+	switch {
+	case ename == "MemoryError" && l.AddressSpace > 0:
+		return "address_space"
+	case errno == int(syscall.EMFILE) && l.OpenFiles > 0:
+		return "open_files"
+	case errno == int(syscall.EAGAIN) && ename == "BlockingIOError" && l.Processes > 0:
+		return "processes"
+	}
+	return ""
+}
+
+func formatSize(bytes uint64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(bytes)
+	i := 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	return fmt.Sprintf("%.1f %s", value, units[i])
+}
+
+// parseSize reads a byte count with an optional binary suffix: "512M", "4G", "4GiB"
+func parseSize(value string) (uint64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	value = strings.TrimSuffix(strings.TrimSuffix(value, "B"), "I")
+	multiplier := uint64(1)
+	if n := len(value); n > 0 {
+		switch value[n-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			value = value[:n-1]
+		}
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("not a size: %q", value)
+	}
+	return uint64(number * float64(multiplier)), nil
+}
+
+// limitsSetting reads the server's resource limits from the environment. Invalid values are
+// logged and ignored.
+func limitsSetting() ResourceLimits {
+	read := func(name string, parse func(string) (uint64, error)) uint64 {
+		value := strings.TrimSpace(os.Getenv(name))
+		if value == "" {
+			return 0
+		}
+		n, err := parse(value)
+		if err != nil {
+			log.Printf("Ignoring %s=%q: %v", name, value, err)
+			return 0
+		}
+		return n
+	}
+	count := func(value string) (uint64, error) {
+		return strconv.ParseUint(value, 10, 64)
+	}
+	return ResourceLimits{
+		AddressSpace: read("PYSYNC_LIMIT_MEMORY", parseSize),
+		CPUSeconds:   read("PYSYNC_LIMIT_CPU_SECONDS", count),
+		OpenFiles:    read("PYSYNC_LIMIT_OPEN_FILES", count),
+		Processes:    read("PYSYNC_LIMIT_PROCESSES", count),
+	}
+}
+
+// processLimits is the enforcement of a ResourceLimits on one process and its children. The
+// zero value and nil enforce nothing.
+type processLimits struct {
+	limits ResourceLimits
+	// cgroup is the cgroup the process runs in, or nil when only rlimits apply
+	cgroup *cgroup
+	// seen holds the cgroup event counters already reported; verdict is the limit the process
+	// exited of, once exited is set
+	mu      sync.Mutex
+	seen    cgroupEvents
+	exited  bool
+	verdict string
+}
+
+// limitProcess prepares cmd, which must not have been started, to run under limits. Memory and
+// process limits go into a fresh cgroup when the server can manage cgroups; everything else is
+// applied as rlimits by running cmd through the launcher. The returned processLimits must be
+// released once the process has exited.
+func limitProcess(cmd *exec.Cmd, limits ResourceLimits) (*processLimits, error) {
+	if limits.isZero() || cmd.Err != nil {
+		return nil, nil
+	}
+	p := &processLimits{limits: limits}
+	rlimits := limits
+
+	if getServerConfig().UseCgroups && (limits.AddressSpace > 0 || limits.Processes > 0) {
+		if cg, err := newCgroup(limits); err == nil {
+			p.cgroup = cg
+			cg.attach(cmd)
+			rlimits.AddressSpace, rlimits.Processes = 0, 0
+		}
+	}
+
+	var flags []string
+	for _, limit := range []struct {
+		flag  string
+		value uint64
+	}{
+		{"as", rlimits.AddressSpace},
+		{"cpu", rlimits.CPUSeconds},
+		{"nofile", rlimits.OpenFiles},
+		{"nproc", rlimits.Processes},
+	} {
+		if limit.value > 0 {
+			flags = append(flags, fmt.Sprintf("-%s=%d", limit.flag, limit.value))
+		}
+	}
+	if err := viaLauncher(cmd, flags...); err != nil {
+		p.release()
+		return nil, err
+	}
+	return p, nil
+}
+
+// exceeded names the limit that stopped the process, judging from its exit state (nil while it
+// still runs) and the cgroup's event counters. Each cgroup event is only reported once while
+// the process runs; once it has exited every caller gets the same answer.
+func (p *processLimits) exceeded(state *os.ProcessState) string {
+	if p == nil {
+		return ""
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.exited {
+		return p.verdict
+	}
+	limit := p.check(state)
+	if state != nil {
+		p.exited, p.verdict = true, limit
+	}
+	return limit
+}
+
+func (p *processLimits) check(state *os.ProcessState) string {
+	if p.cgroup != nil {
+		events := p.cgroup.events()
+		oomKills, pidsMax := events.oomKills > p.seen.oomKills, events.pidsMax > p.seen.pidsMax
+		p.seen = events
+		if oomKills {
+			return "address_space"
+		}
+		if pidsMax {
+			return "processes"
+		}
+	}
+	if state == nil || p.limits.CPUSeconds == 0 {
+		return ""
+	}
+	status, ok := state.Sys().(syscall.WaitStatus)
+	switch {
+	case !ok:
+	case status.Signaled():
+		// The soft limit sends SIGXCPU; the hard limit, one second later, SIGKILL
+		used := state.UserTime() + state.SystemTime()
+		if status.Signal() == syscall.SIGXCPU || (status.Signal() == syscall.SIGKILL && used.Seconds() >= float64(p.limits.CPUSeconds)) {
+			return "cpu_seconds"
+		}
+	case status.ExitStatus() == 128+int(syscall.SIGXCPU):
+		// A shell, or the sandbox's init, reports a child killed by a signal through its exit
+		// status
+		return "cpu_seconds"
+	case status.ExitStatus() == 128+int(syscall.SIGKILL):
+		used := state.UserTime() + state.SystemTime()
+		if used.Seconds() >= float64(p.limits.CPUSeconds) {
+			return "cpu_seconds"
+		}
+	}
+	return ""
+}
+
+// release removes the process's cgroup
+func (p *processLimits) release() {
+	if p != nil && p.cgroup != nil {
+		p.cgroup.remove()
+	}
+}
+
+// resourceLimits returns the limits for the session's next kernel or command
+func (c *Client) resourceLimits() ResourceLimits {
+	c.kernelMu.Lock()
+	defer c.kernelMu.Unlock()
+	return c.limits.within(getServerConfig().Limits)
+}
+
+// setLimits handles a set_limits request, whose content is a JSON ResourceLimits. A running
+// kernel is shut down so that the next cell starts under the new limits. The reply carries the
+// limits in effect, which the server's own limits cap.
+func (c *Client) setLimits(req WebSocketMessage) {
+	var limits ResourceLimits
+	if err := json.Unmarshal([]byte(req.Content), &limits); err != nil {
+		c.sendDone(req, "limits", "error", fmt.Sprintf("Error: invalid limits: %v", err))
+		return
+	}
+
+	c.kernelMu.Lock()
+	if limits != c.limits && c.kernel != nil {
+		c.closeKernelLocked()
+	}
+	c.limits = limits
+	c.kernelMu.Unlock()
+
+	data, err := json.Marshal(c.resourceLimits())
+	if err != nil {
+		c.sendDone(req, "limits", "error", fmt.Sprintf("Error: %v", err))
+		return
+	}
+	c.sendDone(req, "limits", "ok", string(data))
+}
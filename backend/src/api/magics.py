@@ -0,0 +1,298 @@
+# PySync magics.
+#
+# Gives the built-in kernel the IPython syntax notebooks are written with:
+# shell escapes (!cmd, x = !cmd), line magics (%pip, %time, %env) and cell
+# magics (%%bash, %%sh, %%writefile, %%time). The kernel runs with this file
+# prepended to kernel.py and passes every cell through transform_magics,
+# which turns magic lines into calls to the Magics object installed in
+# builtins. Lines keep their numbers, so tracebacks point at the cell.
+
+import ast
+import codecs
+import io
+import os
+import re
+import shlex
+import shutil
+import subprocess
+import sys
+import threading
+import time
+import tokenize
+
+# Name under which the Magics object is reachable from cell code.
+MAGICS_NAME = "__pysync_magics__"
+
+# An escape or line magic, optionally assigned to names as in "files = !ls".
+MAGIC_LINE = re.compile(
+    r"^(?:(?P<target>[A-Za-z_][\w.]*(?:\s*,\s*[A-Za-z_][\w.]*)*)\s*=\s*)?"
+    r"(?P<escape>!!|!|%)(?P<rest>.*)$", re.S)
+# How long output may go on arriving after a command has exited, in seconds.
+PUMP_GRACE = 1.0
+# {expression} and $name in shell commands and magic arguments, and $$ for a plain $.
+EXPANSION = re.compile(r"\{([^{}]+)\}|\$\$|\$([A-Za-z_]\w*)")
+
+
+class UsageError(Exception):
+    """A magic that does not exist or was called with arguments it does not take."""
+
+
+def transform_magics(source):
+    """Rewrites the magics of a cell into Python, line for line."""
+    lines = source.splitlines(True)
+    first = next((i for i, line in enumerate(lines) if line.strip()), None)
+    if first is None:
+        return source
+    if lines[first].startswith("%%"):
+        name, _, args = lines[first][2:].strip().partition(" ")
+        body = "".join(lines[first + 1:])
+        # The body starts on the line after the magic, which the call is on
+        return "\n" * first + "%s.cell(%r, %r, %r)\n" % (MAGICS_NAME, name, args.strip(), body)
+    try:
+        ast.parse(source)
+        return source
+    except SyntaxError:
+        pass
+
+    result = []
+    # The lines so far of a Python statement that goes on over the next line. Only lines that
+    # start a statement can be magics, not those inside strings or brackets.
+    statement = ""
+    i = 0
+    while i < len(lines):
+        line = lines[i]
+        i += 1
+        if statement:
+            result.append(line)
+            statement += line
+            if ends_statement(statement):
+                statement = ""
+            continue
+        stripped = line.lstrip()
+        match = MAGIC_LINE.match(stripped.rstrip("\r\n"))
+        if not match or (match.group("escape") == "%" and not match.group("rest")[:1].isalpha()):
+            result.append(line)
+            if not ends_statement(line):
+                statement = line
+            continue
+        # A magic goes on over lines ending with a backslash, like IPython's
+        rest, consumed = match.group("rest"), 0
+        while rest.endswith("\\") and i < len(lines):
+            rest = rest[:-1] + " " + lines[i].strip()
+            i += 1
+            consumed += 1
+        indent = line[:len(line) - len(stripped)]
+        escape, target = match.group("escape"), match.group("target")
+        if escape == "%":
+            name, _, args = rest.partition(" ")
+            call = "%s.line(%r, %r)" % (MAGICS_NAME, name, args.strip())
+        else:
+            capture = escape == "!!" or target is not None
+            call = "%s.system(%r, capture=%r)" % (MAGICS_NAME, rest.strip(), capture)
+        if target is not None:
+            call = "%s = %s" % (target, call)
+        result.append(indent + call + "\n" + "\n" * consumed)
+    return "".join(result)
+
+
+def ends_statement(source):
+    """Tells whether source, which starts a logical line, also ends it, as IPython finds out
+    with tokenize: it does unless a string, a bracket or a backslash carries it on."""
+    try:
+        for _ in tokenize.generate_tokens(io.StringIO(source).readline):
+            pass
+    except tokenize.TokenError:
+        # EOF in a multi-line string or statement
+        return False
+    except SyntaxError:
+        # The compiler will have its say about that
+        pass
+    return True
+
+
+def format_time(seconds):
+    """Formats a duration the way IPython's %time does."""
+    for unit, scale in (("s", 1.0), ("ms", 1e3), ("µs", 1e6)):
+        if seconds >= 1.0 / scale:
+            return "%.3g %s" % (seconds * scale, unit)
+    return "%.3g ns" % (seconds * 1e9)
+
+
+class Magics:
+    """Runs the magics of the cells of a kernel."""
+
+    def __init__(self, kernel):
+        self.kernel = kernel
+        self.line_magics = {"pip": self.pip, "time": self.time, "env": self.env}
+        self.cell_magics = {
+            "bash": self.bash,
+            "sh": self.sh,
+            "writefile": self.writefile,
+            "time": self.time_cell,
+        }
+        # Magics that take Python code, which must not be expanded
+        self.literal = {"time"}
+
+    def line(self, name, args):
+        magic = self.line_magics.get(name)
+        if magic is None:
+            raise UsageError("Line magic function `%%%s` not found." % name)
+        frame = sys._getframe(1)
+        if name not in self.literal:
+            args = self.expand(args, frame)
+        return magic(args, frame)
+
+    def cell(self, name, args, body):
+        magic = self.cell_magics.get(name)
+        if magic is None:
+            raise UsageError("Cell magic `%%%%%s` not found." % name)
+        frame = sys._getframe(1)
+        return magic(self.expand(args, frame), body, frame)
+
+    def expand(self, text, frame):
+        """Substitutes {expression} and $name with their values in the caller's namespace,
+        leaving what does not evaluate as it is."""
+        def substitute(match):
+            if match.group() == "$$":
+                return "$"
+            try:
+                if match.group(1) is not None:
+                    return str(eval(match.group(1), frame.f_globals, frame.f_locals))
+                name = match.group(2)
+                if name in frame.f_locals:
+                    return str(frame.f_locals[name])
+                return str(frame.f_globals[name])
+            except Exception:
+                return match.group()
+
+        return EXPANSION.sub(substitute, text)
+
+    def system(self, command, capture=False):
+        """Runs a shell command, streaming its output or, with capture, returning the lines
+        it printed. The exit status is left in _exit_code."""
+        command = self.expand(command, sys._getframe(1))
+        output = self.run([command], shell=True, capture=capture)
+        return output.splitlines() if capture else None
+
+    def run(self, args, shell=False, capture=False):
+        """Runs a command, forwarding its output to the cell's streams as it comes, and
+        returns its exit status, or what it printed with capture."""
+        self.kernel.flush_streams()
+        process = subprocess.Popen(
+            args, shell=shell, stdin=subprocess.DEVNULL, stdout=subprocess.PIPE, stderr=subprocess.PIPE)
+        captured = []
+        out = captured.append if capture else sys.stdout.write
+        pumps = [
+            threading.Thread(target=self.pump, args=(process.stdout, out), daemon=True),
+            threading.Thread(target=self.pump, args=(process.stderr, sys.stderr.write), daemon=True),
+        ]
+        for pump in pumps:
+            pump.start()
+        try:
+            status = process.wait()
+        except KeyboardInterrupt:
+            # The command is in the kernel's process group and got the interrupt as well
+            try:
+                process.wait(1)
+            except subprocess.TimeoutExpired:
+                process.kill()
+            # Without the frames of subprocess, which are not the user's concern
+            raise KeyboardInterrupt from None
+        finally:
+            # A command left running in the background keeps the pipes open; what it prints
+            # after the grace period is not shown
+            deadline = time.monotonic() + PUMP_GRACE
+            for pump in pumps:
+                pump.join(max(0, deadline - time.monotonic()))
+        self.kernel.namespace["_exit_code"] = status
+        return "".join(captured) if capture else status
+
+    @staticmethod
+    def pump(pipe, write):
+        decoder = codecs.getincrementaldecoder("utf-8")(errors="replace")
+        with pipe:
+            for chunk in iter(lambda: pipe.read1(65536), b""):
+                write(decoder.decode(chunk))
+        write(decoder.decode(b"", final=True))
+
+    def pip(self, args, frame):
+        """%pip runs pip with the kernel's interpreter."""
+        self.run([sys.executable, "-m", "pip"] + shlex.split(args))
+        print("Note: you may need to restart the kernel to use updated packages.")
+
+    def env(self, args, frame):
+        """%env lists the environment, %env NAME returns a variable, and %env NAME=value
+        or %env NAME value sets one."""
+        if not args:
+            return dict(os.environ)
+        if "=" in args:
+            name, _, value = args.partition("=")
+        else:
+            name, _, value = args.partition(" ")
+            if not value:
+                if args not in os.environ:
+                    raise UsageError("Environment does not have key: %s" % args)
+                return os.environ[args]
+        name, value = name.strip(), value.strip()
+        os.environ[name] = value
+        print("env: %s=%s" % (name, value))
+
+    def time(self, args, frame):
+        """%time runs a statement or expression and prints how long it took."""
+        return self.timed(args, frame, frame.f_lineno - 1)
+
+    def time_cell(self, args, body, frame):
+        """%%time runs the body of the cell as Python and prints how long it took."""
+        return self.timed(transform_magics(body), frame, frame.f_lineno)
+
+    def timed(self, source, frame, line_offset):
+        filename = frame.f_code.co_filename
+        tree = ast.parse(source, filename=filename, mode="exec")
+        ast.increment_lineno(tree, line_offset)
+        last = None
+        if tree.body and isinstance(tree.body[-1], ast.Expr):
+            last = compile(ast.Expression(tree.body.pop().value), filename, "eval")
+        body = compile(tree, filename, "exec")
+
+        start, wall = os.times(), time.perf_counter()
+        try:
+            exec(body, frame.f_globals, frame.f_locals)
+            return eval(last, frame.f_globals, frame.f_locals) if last is not None else None
+        finally:
+            end, wall = os.times(), time.perf_counter() - wall
+            user, system = end.user - start.user, end.system - start.system
+            print("CPU times: user %s, sys: %s, total: %s" % (format_time(user), format_time(system), format_time(user + system)))
+            print("Wall time: %s" % format_time(wall))
+
+    def bash(self, args, body, frame):
+        """%%bash runs the body of the cell with bash, raising CalledProcessError if it fails."""
+        shell = shutil.which("bash")
+        if shell is None:
+            raise UsageError("bash is not installed; use %%sh")
+        self.script(shell, body)
+
+    def sh(self, args, body, frame):
+        self.script("/bin/sh", body)
+
+    def script(self, shell, body):
+        status = self.run([shell, "-c", body])
+        if status != 0:
+            raise subprocess.CalledProcessError(status, os.path.basename(shell))
+
+    def writefile(self, args, body, frame):
+        """%%writefile [-a] path writes, or with -a appends, the body of the cell to path."""
+        words = shlex.split(args)
+        append = bool(words) and words[0] in ("-a", "--append")
+        if append:
+            words = words[1:]
+        if len(words) != 1:
+            raise UsageError("usage: %%writefile [-a] filename")
+        path = os.path.expanduser(words[0])
+        if append:
+            print("Appending to %s" % path)
+        elif os.path.exists(path):
+            print("Overwriting %s" % path)
+        else:
+            print("Writing %s" % path)
+        with open(path, "a" if append else "w", encoding="utf-8") as f:
+            f.write(body)
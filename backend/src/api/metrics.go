@@ -0,0 +1,72 @@
+package api
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// ExecutionMetrics describe one run of a python, shell or pip request. They are added to the
+// message that ends the request.
+type ExecutionMetrics struct {
+	// ExecutionCount numbers the executions of a session, starting at 1
+	ExecutionCount int       `json:"execution_count"`
+	Started        time.Time `json:"started"`
+	Ended          time.Time `json:"ended"`
+	// Duration is the wall-clock time in seconds
+	Duration float64 `json:"duration"`
+	// CPUTime is the user plus system CPU time in seconds, including child processes
+	CPUTime float64 `json:"cpu_time,omitempty"`
+	// PeakRSS is the largest resident set size in bytes
+	PeakRSS int64 `json:"peak_rss,omitempty"`
+}
+
+// beginExecution starts the metrics of a request that is about to run
+func (c *Client) beginExecution(req WebSocketMessage) {
+	c.metricsMu.Lock()
+	defer c.metricsMu.Unlock()
+
+	if c.metrics == nil {
+		c.metrics = make(map[string]*ExecutionMetrics)
+	}
+	c.executionCount++
+	c.metrics[req.MsgID] = &ExecutionMetrics{ExecutionCount: c.executionCount, Started: time.Now()}
+}
+
+// recordUsage adds the CPU time and peak memory of a running request to its metrics
+func (c *Client) recordUsage(req WebSocketMessage, cpu time.Duration, peakRSS int64) {
+	c.metricsMu.Lock()
+	defer c.metricsMu.Unlock()
+
+	if m := c.metrics[req.MsgID]; m != nil {
+		m.CPUTime = cpu.Seconds()
+		m.PeakRSS = peakRSS
+	}
+}
+
+// recordProcessUsage records the resource usage of an exited process
+func (c *Client) recordProcessUsage(req WebSocketMessage, state *os.ProcessState) {
+	if state == nil {
+		return
+	}
+	var peakRSS int64
+	if usage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		peakRSS = maxRSSBytes(usage)
+	}
+	c.recordUsage(req, state.UserTime()+state.SystemTime(), peakRSS)
+}
+
+// finishExecution completes the metrics of req, if it was run, for the message that ends it
+func (c *Client) finishExecution(req WebSocketMessage) *ExecutionMetrics {
+	c.metricsMu.Lock()
+	defer c.metricsMu.Unlock()
+
+	m := c.metrics[req.MsgID]
+	if m == nil {
+		return nil
+	}
+	delete(c.metrics, req.MsgID)
+	m.Ended = time.Now()
+	m.Duration = m.Ended.Sub(m.Started).Seconds()
+	return m
+}
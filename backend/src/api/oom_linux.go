@@ -0,0 +1,57 @@
+package api
+
+import (
+	"errors"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// cgroupOOMKills returns how many processes of the backend's cgroup, which kernels without a
+// cgroup of their own share, the OOM killer has taken so far
+func cgroupOOMKills() int64 {
+	own, err := ownCgroup()
+	if err != nil {
+		return 0
+	}
+	return readCgroupCounter(filepath.Join(own, "memory.events"), "oom_kill")
+}
+
+// kernelLogOOMKill looks through the kernel log for the OOM killer's record of killing pid and
+// returns it, or "" when there is none or the log cannot be read, which takes CAP_SYSLOG
+// unless kernel.dmesg_restrict is off
+func kernelLogOOMKill(pid int) string {
+	fd, err := syscall.Open("/dev/kmsg", syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return ""
+	}
+	defer syscall.Close(fd)
+
+	killed := "Killed process " + strconv.Itoa(pid) + " "
+	oomKill := ",pid=" + strconv.Itoa(pid) + ","
+	var found string
+	// Every read returns one record, "priority,sequence,timestamp,flags;message"
+	buf := make([]byte, 8192)
+	for {
+		n, err := syscall.Read(fd, buf)
+		if errors.Is(err, syscall.EPIPE) {
+			// The record was overwritten while reading; go on with the next one
+			continue
+		}
+		if err != nil || n <= 0 {
+			break
+		}
+		record := string(buf[:n])
+		_, message, ok := strings.Cut(record, ";")
+		if !ok {
+			continue
+		}
+		message, _, _ = strings.Cut(message, "\n")
+		if strings.Contains(message, killed) || (strings.HasPrefix(message, "oom-kill:") && strings.Contains(message+",", oomKill)) {
+			// A later record about a reused pid wins over an earlier one
+			found = message
+		}
+	}
+	return found
+}
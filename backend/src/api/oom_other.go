@@ -0,0 +1,13 @@
+//go:build !linux
+
+package api
+
+// cgroupOOMKills is always zero outside Linux, which has no cgroups
+func cgroupOOMKills() int64 {
+	return 0
+}
+
+// kernelLogOOMKill finds nothing outside Linux, whose kernel log is the only one read
+func kernelLogOOMKill(pid int) string {
+	return ""
+}
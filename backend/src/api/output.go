@@ -0,0 +1,118 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// errSessionClosed refuses to create files for a session that has ended
+var errSessionClosed = errors.New("the session is closed")
+
+// outputFiles maps the download tokens of every session to the files holding the full output
+// of executions that went over the inline output limit
+var (
+	outputFilesMu sync.Mutex
+	outputFiles   = make(map[string]string)
+)
+
+// createOutputFile creates a file for the full output of an execution in the session's output
+// directory. That is created on first use, hidden in the session's workspace or, if the
+// workspace is not writable, in the system temp directory.
+func (c *Client) createOutputFile() (*os.File, error) {
+	workspace := c.workspace()
+	c.outputMu.Lock()
+	defer c.outputMu.Unlock()
+
+	// removeOutputFiles runs once the session is done; nothing may be left behind after it
+	select {
+	case <-c.done:
+		return nil, errSessionClosed
+	default:
+	}
+	if c.outputDir == "" {
+		dir, err := os.MkdirTemp(workspace, ".pysync_output_")
+		if err != nil {
+			log.Printf("Cannot keep output in the workspace: %v", err)
+			if dir, err = os.MkdirTemp("", "pysync_output_"); err != nil {
+				return nil, err
+			}
+		}
+		c.outputDir = dir
+	}
+	return os.CreateTemp(c.outputDir, "output_*.txt")
+}
+
+// publishOutputFile makes the file at path downloadable for as long as the session lasts and
+// returns its URL, relative to the server, or "" once the session is closed
+func (c *Client) publishOutputFile(path string) string {
+	token := newMessageID()
+	c.outputMu.Lock()
+	defer c.outputMu.Unlock()
+	select {
+	case <-c.done:
+		return ""
+	default:
+	}
+	outputFilesMu.Lock()
+	outputFiles[token] = path
+	outputFilesMu.Unlock()
+	c.outputTokens = append(c.outputTokens, token)
+	return "/output/" + token
+}
+
+// removeOutputFiles withdraws the session's downloads and deletes its output directory
+func (c *Client) removeOutputFiles() {
+	c.outputMu.Lock()
+	defer c.outputMu.Unlock()
+
+	outputFilesMu.Lock()
+	for _, token := range c.outputTokens {
+		delete(outputFiles, token)
+	}
+	outputFilesMu.Unlock()
+	c.outputTokens = nil
+
+	if c.outputDir != "" {
+		if err := os.RemoveAll(c.outputDir); err != nil {
+			log.Printf("Error removing output directory: %v", err)
+		}
+		c.outputDir = ""
+	}
+}
+
+// OutputHandler serves the full output of a truncated execution at the URL given in its
+// output_truncated message
+func OutputHandler(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, "/output/")
+	outputFilesMu.Lock()
+	path, ok := outputFiles[token]
+	outputFilesMu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		log.Printf("Error opening output file: %v", err)
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	name := filepath.Base(path)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	http.ServeContent(w, r, name, info.ModTime(), file)
+}
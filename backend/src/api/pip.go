@@ -0,0 +1,247 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// pipListTimeout bounds the `pip list` runs used to snapshot the installed packages
+const pipListTimeout = defaultExecTimeout
+
+// Package is an installed distribution as reported by `pip list`
+type Package struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// PackageChange is one package a pip_install or pip_uninstall request affected
+type PackageChange struct {
+	Name string `json:"name"`
+	// Action is "installed", "upgraded", "downgraded", "changed" or "removed"
+	Action     string `json:"action"`
+	OldVersion string `json:"old_version,omitempty"`
+	NewVersion string `json:"new_version,omitempty"`
+}
+
+// pipCommand builds `python -m pip <args>` for the session's interpreter. pip runs in the
+// session's workspace, so relative paths such as `-r requirements.txt` and `-e .` resolve there.
+// The session's resource limits apply. In a sandboxed session pip runs in the sandbox too, with
+// the network and with write access to the interpreter's environment, so that it can install
+// packages there but nowhere else. The returned processLimits must be released once pip exited.
+func (c *Client) pipCommand(ctx context.Context, args ...string) (*exec.Cmd, *processLimits, error) {
+	pythonPath := c.interpreterPath()
+	if pythonPath == "" {
+		return nil, nil, ErrNoInterpreter
+	}
+	options := c.processOptions()
+	options.Sandbox.Network = true
+	cmd := exec.CommandContext(ctx, pythonPath, append([]string{"-m", "pip"}, args...)...)
+	cmd.Dir = options.Workdir
+	cmd.Env = append(os.Environ(), "PIP_DISABLE_PIP_VERSION_CHECK=1", "PIP_NO_INPUT=1", "PYTHONUNBUFFERED=1")
+	limited, err := confine(cmd, options, installationRoots(pythonPath)...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cmd, limited, nil
+}
+
+// listPackages returns the packages installed for the session's interpreter
+func (c *Client) listPackages() ([]Package, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), pipListTimeout)
+	defer cancel()
+
+	cmd, limited, err := c.pipCommand(ctx, "list", "--format=json")
+	if err != nil {
+		return nil, err
+	}
+	defer limited.release()
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("pip list failed: %s", msg)
+		}
+		return nil, fmt.Errorf("pip list failed: %w", err)
+	}
+	var packages []Package
+	if err := json.Unmarshal(out, &packages); err != nil {
+		return nil, fmt.Errorf("invalid pip list output: %w", err)
+	}
+	return packages, nil
+}
+
+// diffPackages compares two snapshots of the installed packages
+func diffPackages(before []Package, after []Package) []PackageChange {
+	versions := map[string]string{}
+	for _, pkg := range before {
+		versions[normalizePackageName(pkg.Name)] = pkg.Version
+	}
+
+	changes := []PackageChange{}
+	for _, pkg := range after {
+		key := normalizePackageName(pkg.Name)
+		old, existed := versions[key]
+		delete(versions, key)
+		switch {
+		case !existed:
+			changes = append(changes, PackageChange{Name: pkg.Name, Action: "installed", NewVersion: pkg.Version})
+		case old != pkg.Version:
+			changes = append(changes, PackageChange{Name: pkg.Name, Action: versionChange(old, pkg.Version), OldVersion: old, NewVersion: pkg.Version})
+		}
+	}
+	for _, pkg := range before {
+		if old, removed := versions[normalizePackageName(pkg.Name)]; removed {
+			changes = append(changes, PackageChange{Name: pkg.Name, Action: "removed", OldVersion: old})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+	return changes
+}
+
+// normalizePackageName applies the PEP 503 name normalization
+func normalizePackageName(name string) string {
+	name = strings.ToLower(name)
+	return strings.NewReplacer("_", "-", ".", "-").Replace(name)
+}
+
+// versionChange tells an upgrade from a downgrade by comparing the dotted numeric parts of two
+// versions, a missing part counting as 0. Versions it cannot order, such as local or
+// pre-release builds, are just "changed".
+func versionChange(old string, new string) string {
+	oldParts, newParts := strings.Split(old, "."), strings.Split(new, ".")
+	part := func(parts []string, i int) (int, bool) {
+		if i >= len(parts) {
+			return 0, true
+		}
+		// The whole part, so that "0rc1" or "2a" is not taken for a plain number
+		n, err := strconv.Atoi(parts[i])
+		return n, err == nil
+	}
+	for i := 0; i < len(oldParts) || i < len(newParts); i++ {
+		a, ok := part(oldParts, i)
+		if !ok {
+			return "changed"
+		}
+		b, ok := part(newParts, i)
+		if !ok {
+			return "changed"
+		}
+		if a != b {
+			if b > a {
+				return "upgraded"
+			}
+			return "downgraded"
+		}
+	}
+	return "changed"
+}
+
+// runPip handles pip_install and pip_uninstall requests. The content lists the requirements to
+// install or the packages to remove, separated by whitespace, and may include pip options. Output
+// streams as pip_stream messages; pip_done carries the changed packages as JSON. pip runs
+// without the server default timeout, but a request timeout and the server maximum still apply.
+func (c *Client) runPip(req WebSocketMessage) {
+	args := strings.Fields(req.Content)
+	if len(args) == 0 {
+		c.sendDone(req, "pip_done", "error", "Error: no packages given")
+		return
+	}
+	if req.Type == "pip_install" {
+		args = append([]string{"install"}, args...)
+	} else {
+		args = append([]string{"uninstall", "--yes"}, args...)
+	}
+
+	config := getServerConfig()
+	config.DefaultTimeout = 0
+	limit, err := resolveTimeout(req, config)
+	if err != nil {
+		c.sendDone(req, "pip_done", "error", fmt.Sprintf("Error: %v", err))
+		return
+	}
+
+	before, err := c.listPackages()
+	if err != nil {
+		log.Printf("Error listing packages: %v", err)
+		c.sendDone(req, "pip_done", "error", fmt.Sprintf("Error: %v", err))
+		return
+	}
+
+	ctx, cancel := limit.context()
+	defer cancel()
+
+	cmd, limited, err := c.pipCommand(ctx, args...)
+	if err != nil {
+		c.sendDone(req, "pip_done", "error", fmt.Sprintf("Error: %v", err))
+		return
+	}
+	defer limited.release()
+	log.Printf("Running pip: %s", strings.Join(cmd.Args, " "))
+	stream := newOutputStream(c, req, "pip_stream")
+	cmd.Stdout = stream.Writer("stdout")
+	cmd.Stderr = stream.Writer("stderr")
+
+	run, runErr := c.runProcess(req, "pip", cmd)
+	stream.Close()
+	c.recordProcessUsage(req, cmd.ProcessState)
+	var exceeded string
+	if runErr != nil {
+		exceeded = limited.exceeded(cmd.ProcessState)
+	}
+
+	// A failed or stopped install may still have changed some packages
+	after, err := c.listPackages()
+	if err != nil {
+		log.Printf("Error listing packages: %v", err)
+		after = before
+	}
+	result := struct {
+		Changes []PackageChange `json:"changes"`
+		Error   string          `json:"error,omitempty"`
+	}{Changes: diffPackages(before, after)}
+	status := "ok"
+	switch outcome := run.outcome(); {
+	case outcome != "" && runErr != nil:
+		status = outcome
+	case exceeded != "":
+		status, result.Error = "limit_exceeded", fmt.Sprintf("Stopped by the %s", c.resourceLimits().describe(exceeded))
+	case ctx.Err() == context.DeadlineExceeded:
+		status, result.Error = "timeout", limit.message()
+	case runErr != nil:
+		status, result.Error = "error", runErr.Error()
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		c.sendDone(req, "pip_done", "error", fmt.Sprintf("Error: %v", err))
+		return
+	}
+	done := WebSocketMessage{Type: "pip_done", Status: status, Content: string(data)}
+	if status == "limit_exceeded" {
+		done.Limit = exceeded
+	}
+	c.sendDoneMessage(req, done)
+}
+
+// sendPackageList answers a pip_list request with the installed packages as JSON
+func (c *Client) sendPackageList(req WebSocketMessage) {
+	packages, err := c.listPackages()
+	if err != nil {
+		log.Printf("Error listing packages: %v", err)
+		c.sendDone(req, "pip_list", "error", fmt.Sprintf("Error: %v", err))
+		return
+	}
+	data, err := json.Marshal(packages)
+	if err != nil {
+		c.sendDone(req, "pip_list", "error", fmt.Sprintf("Error: %v", err))
+		return
+	}
+	c.sendDone(req, "pip_list", "ok", string(data))
+}
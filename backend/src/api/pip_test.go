@@ -0,0 +1,96 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestVersionChange(t *testing.T) {
+	tests := []struct {
+		old, new string
+		want     string
+	}{
+		{"1.0", "1.1", "upgraded"},
+		{"1.1", "1.0", "downgraded"},
+		{"1.9", "1.10", "upgraded"},
+		{"2.0", "10.0", "upgraded"},
+		{"1.26.4", "2.0.0", "upgraded"},
+		{"2.0.0", "1.26.4", "downgraded"},
+		{"1.0", "1.0.1", "upgraded"},
+		{"1.0.1", "1.0", "downgraded"},
+		{"1.0", "1.0.0", "changed"},
+		{"1.0rc1", "1.0", "changed"},
+		{"1.0", "1.0rc1", "changed"},
+		{"1rc1", "2", "changed"},
+		{"2a", "1", "changed"},
+		{"1.0rc1", "1.1", "changed"},
+		{"1.0", "1.0.post1", "changed"},
+		{"2.1.0+cpu", "2.1.0+cu121", "changed"},
+		{"abc", "def", "changed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.old+" to "+tt.new, func(t *testing.T) {
+			if got := versionChange(tt.old, tt.new); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffPackages(t *testing.T) {
+	tests := []struct {
+		name          string
+		before, after []Package
+		want          []PackageChange
+	}{
+		{
+			name:   "nothing changed",
+			before: []Package{{"numpy", "1.26.4"}},
+			after:  []Package{{"numpy", "1.26.4"}},
+			want:   []PackageChange{},
+		},
+		{
+			name:   "installed",
+			before: []Package{{"numpy", "1.26.4"}},
+			after:  []Package{{"numpy", "1.26.4"}, {"pandas", "2.2.2"}},
+			want:   []PackageChange{{Name: "pandas", Action: "installed", NewVersion: "2.2.2"}},
+		},
+		{
+			name:   "removed",
+			before: []Package{{"numpy", "1.26.4"}, {"six", "1.16.0"}},
+			after:  []Package{{"numpy", "1.26.4"}},
+			want:   []PackageChange{{Name: "six", Action: "removed", OldVersion: "1.16.0"}},
+		},
+		{
+			name:   "upgraded and downgraded",
+			before: []Package{{"numpy", "1.26.4"}, {"scipy", "1.13.0"}},
+			after:  []Package{{"numpy", "2.0.0"}, {"scipy", "1.12.0"}},
+			want: []PackageChange{
+				{Name: "numpy", Action: "upgraded", OldVersion: "1.26.4", NewVersion: "2.0.0"},
+				{Name: "scipy", Action: "downgraded", OldVersion: "1.13.0", NewVersion: "1.12.0"},
+			},
+		},
+		{
+			name:   "names compared after normalization",
+			before: []Package{{"typing_extensions", "4.11.0"}, {"Zope.Interface", "6.3"}},
+			after:  []Package{{"typing-extensions", "4.12.2"}, {"zope-interface", "6.3"}},
+			want:   []PackageChange{{Name: "typing-extensions", Action: "upgraded", OldVersion: "4.11.0", NewVersion: "4.12.2"}},
+		},
+		{
+			name:   "sorted by name",
+			before: nil,
+			after:  []Package{{"zlib", "1"}, {"attrs", "23.2.0"}},
+			want: []PackageChange{
+				{Name: "attrs", Action: "installed", NewVersion: "23.2.0"},
+				{Name: "zlib", Action: "installed", NewVersion: "1"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := diffPackages(tt.before, tt.after); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
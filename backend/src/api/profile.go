@@ -0,0 +1,77 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// ExecuteOptions change how a kernel runs a cell
+type ExecuteOptions struct {
+	// Profile runs the cell under cProfile, and ProfileMemory under tracemalloc as well; the
+	// execute_reply then carries a ProfileReport
+	Profile       bool
+	ProfileMemory bool
+}
+
+// ProfileReport is what a profiled cell spent its time and memory on
+type ProfileReport struct {
+	// TotalTime is the time, in seconds, spent in the cell's code, and TotalCalls the number of
+	// function calls it made
+	TotalTime  float64 `json:"total_time"`
+	TotalCalls int     `json:"total_calls"`
+	// Functions are the functions with the highest cumulative time, highest first
+	Functions []ProfiledFunction `json:"functions"`
+	// Memory is set for cells profiled with profile_memory
+	Memory *MemoryProfile `json:"memory,omitempty"`
+}
+
+// ProfiledFunction is one line of a cProfile report
+type ProfiledFunction struct {
+	Function string `json:"function"`
+	// Filename and Lineno are empty for builtins
+	Filename string `json:"filename"`
+	Lineno   int    `json:"lineno"`
+	// Calls counts every call, PrimitiveCalls those that were not recursive
+	Calls          int `json:"calls"`
+	PrimitiveCalls int `json:"primitive_calls"`
+	// TotalTime is the time spent in the function itself, CumulativeTime includes the
+	// functions it called, both in seconds
+	TotalTime      float64 `json:"total_time"`
+	CumulativeTime float64 `json:"cumulative_time"`
+}
+
+// MemoryProfile is the tracemalloc report of a cell
+type MemoryProfile struct {
+	// Peak is the most memory, in bytes, traced at once while the cell ran, and Allocated what
+	// was still allocated when it ended
+	Peak      int64 `json:"peak"`
+	Allocated int64 `json:"allocated"`
+	// Sites are the source lines that allocated most of what was left, biggest first
+	Sites []AllocationSite `json:"sites"`
+}
+
+// AllocationSite is the memory allocated by one source line that was still in use at the end
+// of the cell
+type AllocationSite struct {
+	Filename string `json:"filename"`
+	Lineno   int    `json:"lineno"`
+	Line     string `json:"line"`
+	Size     int64  `json:"size"`
+	Count    int    `json:"count"`
+}
+
+// executeOptions reads the options of a python request
+func executeOptions(req WebSocketMessage) ExecuteOptions {
+	return ExecuteOptions{Profile: req.Profile || req.ProfileMemory, ProfileMemory: req.ProfileMemory}
+}
+
+// sendProfile reports the profile of a cell in a python_profile message, whose content is the
+// ProfileReport as JSON
+func (c *Client) sendProfile(req WebSocketMessage, report *ProfileReport) {
+	data, err := json.Marshal(report)
+	if err != nil {
+		log.Printf("Error encoding profile: %v", err)
+		return
+	}
+	c.reply(req, WebSocketMessage{Type: "python_profile", Content: string(data)})
+}
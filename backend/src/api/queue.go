@@ -0,0 +1,200 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// executionQueue runs the executions of a session one at a time, in the order they arrived
+// unless the client reorders them. Interrupt, kill and input messages bypass it.
+type executionQueue struct {
+	mu      sync.Mutex
+	entries []*queuedExecution
+	running *queuedExecution
+	// ready is signalled whenever an entry is added
+	ready chan struct{}
+}
+
+// queuedExecution is a request waiting for its turn
+type queuedExecution struct {
+	req WebSocketMessage
+	// doneType is the message that ends the request, sent with status "cancelled" when it is
+	// cancelled before it runs
+	doneType string
+	run      func(WebSocketMessage)
+}
+
+// queueEntry describes a queued or running execution in a queue message
+type queueEntry struct {
+	MsgID  string `json:"msg_id"`
+	CellID string `json:"cell_id,omitempty"`
+	Type   string `json:"type"`
+}
+
+func newExecutionQueue() *executionQueue {
+	return &executionQueue{ready: make(chan struct{}, 1)}
+}
+
+// enqueue adds req to the session's queue; run executes it when its turn comes. The client is
+// told the request's position with an execution_status message. Requests without a msg_id get
+// one so that the status messages can refer to them.
+func (c *Client) enqueue(req WebSocketMessage, doneType string, run func(WebSocketMessage)) {
+	if req.MsgID == "" {
+		req.MsgID = newMessageID()
+	}
+	q := c.queue
+	q.mu.Lock()
+	q.entries = append(q.entries, &queuedExecution{req: req, doneType: doneType, run: run})
+	// Still under the lock, so that "queued" goes out before the runner's "running"
+	c.sendExecutionStatus(req, "queued", len(q.entries))
+	q.mu.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// runQueue executes queued requests until the connection closes
+func (c *Client) runQueue() {
+	q := c.queue
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-q.ready:
+		}
+		for {
+			select {
+			case <-c.done:
+				return
+			default:
+			}
+			q.mu.Lock()
+			if len(q.entries) == 0 {
+				q.mu.Unlock()
+				break
+			}
+			entry := q.entries[0]
+			q.entries = q.entries[1:]
+			q.running = entry
+			q.mu.Unlock()
+
+			c.beginExecution(entry.req)
+			c.sendExecutionStatus(entry.req, "running", 0)
+			entry.run(entry.req)
+			c.sendExecutionStatus(entry.req, "done", 0)
+
+			q.mu.Lock()
+			q.running = nil
+			q.mu.Unlock()
+		}
+	}
+}
+
+func (c *Client) sendExecutionStatus(req WebSocketMessage, status string, position int) {
+	c.reply(req, WebSocketMessage{Type: "execution_status", Status: status, Position: position})
+}
+
+// cancelQueued handles a cancel request: the queued execution whose msg_id is the parent_id is
+// dropped, or every queued execution when there is no parent_id. Running executions are left
+// alone; interrupt and kill stop those.
+func (c *Client) cancelQueued(req WebSocketMessage) {
+	q := c.queue
+	q.mu.Lock()
+	var cancelled []*queuedExecution
+	kept := q.entries[:0]
+	for _, entry := range q.entries {
+		if req.ParentID == "" || req.ParentID == entry.req.MsgID {
+			cancelled = append(cancelled, entry)
+		} else {
+			kept = append(kept, entry)
+		}
+	}
+	q.entries = kept
+	q.mu.Unlock()
+
+	if len(cancelled) == 0 {
+		c.sendDone(req, "cancel_reply", "not_queued", "Nothing to cancel")
+		return
+	}
+	for _, entry := range cancelled {
+		log.Printf("Cancelled queued %s request %s", entry.req.Type, entry.req.MsgID)
+		c.sendDone(entry.req, entry.doneType, "cancelled", "")
+		c.sendExecutionStatus(entry.req, "cancelled", 0)
+	}
+	c.sendQueue(req, "cancel_reply")
+}
+
+// reorderQueue handles a reorder_queue request, whose content is a JSON list of msg_ids of
+// queued executions. Those move to the front of the queue in the given order; the others
+// follow in their current order.
+func (c *Client) reorderQueue(req WebSocketMessage) {
+	var order []string
+	if err := json.Unmarshal([]byte(req.Content), &order); err != nil {
+		c.sendDone(req, "queue", "error", fmt.Sprintf("Error: invalid queue order: %v", err))
+		return
+	}
+
+	q := c.queue
+	q.mu.Lock()
+	byID := make(map[string]*queuedExecution, len(q.entries))
+	for _, entry := range q.entries {
+		byID[entry.req.MsgID] = entry
+	}
+	var unknown []string
+	entries := make([]*queuedExecution, 0, len(q.entries))
+	for _, id := range order {
+		if entry, ok := byID[id]; ok {
+			entries = append(entries, entry)
+			delete(byID, id)
+		} else {
+			unknown = append(unknown, id)
+		}
+	}
+	for _, entry := range q.entries {
+		if _, ok := byID[entry.req.MsgID]; ok {
+			entries = append(entries, entry)
+		}
+	}
+	if len(unknown) == 0 {
+		q.entries = entries
+	}
+	q.mu.Unlock()
+
+	if len(unknown) > 0 {
+		c.sendDone(req, "queue", "error", fmt.Sprintf("Error: not queued: %v", unknown))
+		return
+	}
+	c.sendQueue(req, "queue")
+}
+
+// sendQueue replies with the running execution and the queued ones in order as JSON
+func (c *Client) sendQueue(req WebSocketMessage, replyType string) {
+	describe := func(entry *queuedExecution) queueEntry {
+		return queueEntry{MsgID: entry.req.MsgID, CellID: entry.req.CellID, Type: entry.req.Type}
+	}
+	q := c.queue
+	q.mu.Lock()
+	state := struct {
+		Running *queueEntry  `json:"running"`
+		Queued  []queueEntry `json:"queued"`
+	}{Queued: make([]queueEntry, 0, len(q.entries))}
+	if q.running != nil {
+		running := describe(q.running)
+		state.Running = &running
+	}
+	for _, entry := range q.entries {
+		state.Queued = append(state.Queued, describe(entry))
+	}
+	q.mu.Unlock()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		c.sendDone(req, replyType, "error", fmt.Sprintf("Error: %v", err))
+		return
+	}
+	c.sendDone(req, replyType, "ok", string(data))
+}
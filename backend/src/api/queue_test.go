@@ -0,0 +1,73 @@
+package api
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// queuedClient returns a client whose queue holds executions with the given msg_ids and whose
+// replies can be read from its send channel
+func queuedClient(ids ...string) *Client {
+	c := &Client{
+		send:  make(chan []byte, 16),
+		done:  make(chan struct{}),
+		queue: newExecutionQueue(),
+	}
+	for _, id := range ids {
+		req := WebSocketMessage{Type: "python", MsgID: id}
+		c.queue.entries = append(c.queue.entries, &queuedExecution{req: req, doneType: "python_done"})
+	}
+	return c
+}
+
+func queuedIDs(q *executionQueue) []string {
+	ids := []string{}
+	for _, entry := range q.entries {
+		ids = append(ids, entry.req.MsgID)
+	}
+	return ids
+}
+
+func TestReorderQueue(t *testing.T) {
+	tests := []struct {
+		name       string
+		queued     []string
+		order      string
+		want       []string
+		wantStatus string
+	}{
+		{"reversed", []string{"a", "b", "c"}, `["c", "b", "a"]`, []string{"c", "b", "a"}, "ok"},
+		{"moved to the front", []string{"a", "b", "c"}, `["c"]`, []string{"c", "a", "b"}, "ok"},
+		{"others keep their order", []string{"a", "b", "c", "d"}, `["d", "b"]`, []string{"d", "b", "a", "c"}, "ok"},
+		{"empty order", []string{"a", "b"}, `[]`, []string{"a", "b"}, "ok"},
+		{"repeated id", []string{"a", "b"}, `["b", "b"]`, []string{"a", "b"}, "error"},
+		{"unknown id", []string{"a", "b"}, `["b", "x"]`, []string{"a", "b"}, "error"},
+		{"not a list", []string{"a", "b"}, `"b"`, []string{"a", "b"}, "error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := queuedClient(tt.queued...)
+			c.reorderQueue(WebSocketMessage{Type: "reorder_queue", MsgID: "reorder", Content: tt.order})
+
+			if got := queuedIDs(c.queue); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got queue %v, want %v", got, tt.want)
+			}
+			var reply WebSocketMessage
+			if err := json.Unmarshal(<-c.send, &reply); err != nil {
+				t.Fatal(err)
+			}
+			if reply.Type != "queue" || reply.ParentID != "reorder" || reply.Status != tt.wantStatus {
+				t.Errorf("got %s reply to %q with status %q, want queue reply to %q with status %q",
+					reply.Type, reply.ParentID, reply.Status, "reorder", tt.wantStatus)
+			}
+			if tt.wantStatus == "ok" {
+				want := `"queued":[{"msg_id":"` + strings.Join(tt.want, `","type":"python"},{"msg_id":"`) + `","type":"python"}]`
+				if !strings.Contains(reply.Content, want) {
+					t.Errorf("got content %s, want the queue %v", reply.Content, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,8 @@
+package api
+
+import "syscall"
+
+// maxRSSBytes reads the peak resident set size of a rusage, which macOS reports in bytes
+func maxRSSBytes(usage *syscall.Rusage) int64 {
+	return int64(usage.Maxrss)
+}
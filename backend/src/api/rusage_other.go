@@ -0,0 +1,10 @@
+//go:build !darwin
+
+package api
+
+import "syscall"
+
+// maxRSSBytes reads the peak resident set size of a rusage, which Linux reports in KiB
+func maxRSSBytes(usage *syscall.Rusage) int64 {
+	return int64(usage.Maxrss) * 1024
+}
@@ -0,0 +1,176 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// SandboxOptions controls whether a session's kernel and shell commands run isolated from the
+// host. A sandboxed execution runs in new user, mount and PID namespaces: it sees its working
+// directory read-write, the system directories and its interpreter read-only, and nothing else
+// of the host filesystem.
+type SandboxOptions struct {
+	Enabled bool `json:"enabled"`
+	// Network keeps the host network. Without it the sandbox gets a network namespace of its
+	// own with only loopback.
+	Network bool `json:"network"`
+}
+
+// within returns the options a session gets when the server has its own: a server sandbox
+// cannot be turned off, and neither can its network isolation
+func (s SandboxOptions) within(server SandboxOptions) SandboxOptions {
+	if !server.Enabled {
+		return s
+	}
+	return SandboxOptions{Enabled: true, Network: s.Network && server.Network}
+}
+
+// sandboxSetting reads the server's sandbox options from the environment
+func sandboxSetting() SandboxOptions {
+	enabled := func(name string) bool {
+		switch strings.ToLower(strings.TrimSpace(os.Getenv(name))) {
+		case "1", "on", "true", "yes":
+			return true
+		}
+		return false
+	}
+	return SandboxOptions{Enabled: enabled("PYSYNC_SANDBOX"), Network: enabled("PYSYNC_SANDBOX_NETWORK")}
+}
+
+// sandboxSpec is what the launcher needs to build the sandbox's filesystem
+type sandboxSpec struct {
+	enabled        bool
+	isolateNetwork bool
+	// workdir is the working directory inside the sandbox; it is mounted read-write
+	workdir string
+	// readOnly and readWrite are host paths mounted at the same place in the sandbox, on top
+	// of the system directories every sandbox gets
+	readOnly  []string
+	readWrite []string
+}
+
+// sandboxProcess prepares cmd, which must not have been started, to run in the sandbox when
+// options enable it. The command's working directory, or the server's when it has none, and
+// the writable paths are mounted read-write; the command's interpreter and the server's
+// PYSYNC_SANDBOX_PATHS read-only.
+func sandboxProcess(cmd *exec.Cmd, options SandboxOptions, writable ...string) error {
+	if !options.Enabled || cmd.Err != nil {
+		return nil
+	}
+	workdir := cmd.Dir
+	if workdir == "" {
+		var err error
+		if workdir, err = os.Getwd(); err != nil {
+			return fmt.Errorf("cannot find the sandbox working directory: %w", err)
+		}
+	}
+	workdir, err := filepath.Abs(workdir)
+	if err != nil {
+		return err
+	}
+	if isSystemPath(workdir) {
+		// It would be mounted writable, system directories and all
+		return fmt.Errorf("the sandbox cannot run in %s", workdir)
+	}
+
+	flags := []string{"-sandbox", "-workdir=" + workdir, "-rw=" + workdir}
+	if !options.Network {
+		flags = append(flags, "-isolate-network")
+	}
+	for _, path := range writable {
+		flags = append(flags, "-rw="+path)
+	}
+	readOnly := append(installationRoots(cmd.Path), getServerConfig().SandboxPaths...)
+	for _, path := range readOnly {
+		flags = append(flags, "-ro="+path)
+	}
+	if err := isolate(cmd, !options.Network); err != nil {
+		return err
+	}
+	return viaLauncher(cmd, flags...)
+}
+
+// installationRoots guesses the directories a program needs from its path: the parent of its
+// bin directory, which is the prefix of a virtualenv, conda env or pyenv version, for both the
+// path as given and the file it links to. System prefixes are left out, the sandbox has them.
+func installationRoots(path string) []string {
+	var roots []string
+	add := func(path string) {
+		root := filepath.Dir(filepath.Dir(path))
+		if !filepath.IsAbs(root) || isSystemPath(root) {
+			return
+		}
+		for _, existing := range roots {
+			if existing == root {
+				return
+			}
+		}
+		roots = append(roots, root)
+	}
+	add(path)
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		add(resolved)
+	}
+	return roots
+}
+
+// sandboxSystemDirs are the host directories every sandbox sees read-only
+var sandboxSystemDirs = []string{"/usr", "/bin", "/sbin", "/lib", "/lib32", "/lib64", "/libx32", "/etc", "/opt", "/sys"}
+
+// isSystemPath reports whether path is the root or inside one of sandboxSystemDirs
+func isSystemPath(path string) bool {
+	if path == "/" {
+		return true
+	}
+	for _, dir := range sandboxSystemDirs {
+		if path == dir || strings.HasPrefix(path, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// sandboxOptions returns the sandbox options for the session's next kernel or command
+func (c *Client) sandboxOptions() SandboxOptions {
+	c.kernelMu.Lock()
+	defer c.kernelMu.Unlock()
+	return c.sandboxOptionsLocked()
+}
+
+func (c *Client) sandboxOptionsLocked() SandboxOptions {
+	server := getServerConfig().Sandbox
+	if c.sandbox == nil {
+		return server
+	}
+	return c.sandbox.within(server)
+}
+
+// setSandbox handles a set_sandbox request, whose content is a JSON SandboxOptions. A running
+// kernel is shut down so that the next cell starts in the new sandbox. The reply carries the
+// options in effect, which the server's own sandbox settings may override.
+func (c *Client) setSandbox(req WebSocketMessage) {
+	var options SandboxOptions
+	if err := json.Unmarshal([]byte(req.Content), &options); err != nil {
+		c.sendDone(req, "sandbox", "error", fmt.Sprintf("Error: invalid sandbox options: %v", err))
+		return
+	}
+
+	c.kernelMu.Lock()
+	if options.within(getServerConfig().Sandbox) != c.sandboxOptionsLocked() && c.kernel != nil {
+		c.closeKernelLocked()
+	}
+	c.sandbox = &options
+	effective := c.sandboxOptionsLocked()
+	c.kernelMu.Unlock()
+
+	data, err := json.Marshal(effective)
+	if err != nil {
+		c.sendDone(req, "sandbox", "error", fmt.Sprintf("Error: %v", err))
+		return
+	}
+	c.sendDone(req, "sandbox", "ok", string(data))
+}
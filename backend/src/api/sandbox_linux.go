@@ -0,0 +1,388 @@
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Capabilities and prctl options the syscall package does not define
+const (
+	capSetpcap   = 8
+	capNetAdmin  = 12
+	capSysAdmin  = 21
+	capLastValid = 63
+
+	prSetNoNewPrivs      = 38
+	prCapAmbient         = 47
+	prCapAmbientClearAll = 4
+
+	linuxCapabilityVersion3 = 0x20080522
+)
+
+// isolate makes cmd start in new user, mount and PID namespaces, and a new network namespace
+// when isolateNetwork is set. The user namespace maps the server's user to itself, and the
+// launcher keeps just the capabilities it needs to build the sandbox.
+func isolate(cmd *exec.Cmd, isolateNetwork bool) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	attr := cmd.SysProcAttr
+	attr.Cloneflags |= syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID
+	if isolateNetwork {
+		attr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+	attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getuid(), HostID: os.Getuid(), Size: 1}}
+	attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getgid(), HostID: os.Getgid(), Size: 1}}
+	attr.GidMappingsEnableSetgroups = false
+	attr.AmbientCaps = []uintptr{capSetpcap, capNetAdmin, capSysAdmin}
+	return nil
+}
+
+// sandboxMount is one mount of the sandbox's filesystem
+type sandboxMount struct {
+	// path is where the mount goes in the sandbox, and for binds also the host path
+	path string
+	kind string // "bind", "tmpfs", "proc" or "dev"
+	// source is the resolved host path of a bind
+	source   string
+	writable bool
+}
+
+// Paths the launcher uses while it builds the sandbox. The base is a tmpfs mounted over /tmp,
+// which only the launcher's mount namespace sees.
+const (
+	sandboxBase    = "/tmp"
+	sandboxNewRoot = "/newroot"
+	sandboxOldRoot = "/oldroot"
+)
+
+// enterSandbox runs in the launcher, inside the namespaces isolate asked for. It builds a new
+// root filesystem out of read-only binds of the system directories, read-write binds of the
+// working directory, fresh /proc, /dev, /tmp and home directories, switches to it, and gives up
+// every capability so that the command cannot change any of it.
+func enterSandbox(spec sandboxSpec) error {
+	// Capabilities belong to the thread, and the command is exec'd from this one
+	runtime.LockOSThread()
+
+	mounts, err := sandboxMounts(spec)
+	if err != nil {
+		return err
+	}
+
+	// Keep everything that happens here out of the host's mount namespace
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making mounts private: %w", err)
+	}
+	// Move to a scratch root so that the new root can be assembled from the old one, which
+	// stays reachable at /oldroot, without either hiding the other
+	if err := syscall.Mount("tmpfs", sandboxBase, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=0755"); err != nil {
+		return fmt.Errorf("mounting scratch root: %w", err)
+	}
+	for _, dir := range []string{sandboxNewRoot, sandboxOldRoot} {
+		if err := os.Mkdir(sandboxBase+dir, 0755); err != nil {
+			return err
+		}
+	}
+	if err := syscall.PivotRoot(sandboxBase, sandboxBase+sandboxOldRoot); err != nil {
+		return fmt.Errorf("pivot_root: %w", err)
+	}
+	if err := os.Chdir("/"); err != nil {
+		return err
+	}
+	if err := syscall.Mount("tmpfs", sandboxNewRoot, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=0755"); err != nil {
+		return fmt.Errorf("mounting new root: %w", err)
+	}
+
+	for _, m := range mounts {
+		if err := m.mount(); err != nil {
+			return err
+		}
+	}
+	if err := devices(); err != nil {
+		return err
+	}
+	if err := remountReadOnly(mounts); err != nil {
+		return err
+	}
+
+	// Switch to the new root and drop the scratch root, and the old root under it
+	if err := os.Chdir(sandboxNewRoot); err != nil {
+		return err
+	}
+	if err := syscall.PivotRoot(".", "."); err != nil {
+		return fmt.Errorf("pivot_root: %w", err)
+	}
+	if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("detaching the old root: %w", err)
+	}
+	if err := os.Chdir(spec.workdir); err != nil {
+		return err
+	}
+
+	if spec.isolateNetwork {
+		if err := loopbackUp(); err != nil {
+			return fmt.Errorf("bringing up loopback: %w", err)
+		}
+	}
+	return dropCapabilities()
+}
+
+// sandboxMounts lists the mounts of the sandbox, parents before what goes inside them. Host
+// paths are resolved now, while the host's root is still in place.
+func sandboxMounts(spec sandboxSpec) ([]sandboxMount, error) {
+	mounts := []sandboxMount{
+		{path: "/tmp", kind: "tmpfs", writable: true},
+		{path: "/proc", kind: "proc", writable: true},
+		{path: "/dev", kind: "dev", writable: true},
+	}
+	if home := os.Getenv("HOME"); filepath.IsAbs(home) && !isSystemPath(home) {
+		// An empty home for the dotfiles and caches programs like to write
+		mounts = append(mounts, sandboxMount{path: filepath.Clean(home), kind: "tmpfs", writable: true})
+	}
+
+	writable := map[string]bool{}
+	for _, path := range spec.readWrite {
+		writable[filepath.Clean(path)] = true
+	}
+	seen := map[string]bool{}
+	addBind := func(path string, rw bool) error {
+		path = filepath.Clean(path)
+		if seen[path] || (!rw && writable[path]) {
+			return nil
+		}
+		source, err := filepath.EvalSymlinks(path)
+		if os.IsNotExist(err) && !rw {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		seen[path] = true
+		mounts = append(mounts, sandboxMount{path: path, kind: "bind", source: source, writable: rw})
+		return nil
+	}
+	for _, path := range append(append([]string{}, sandboxSystemDirs...), spec.readOnly...) {
+		if err := addBind(path, false); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range spec.readWrite {
+		if err := addBind(path, true); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(mounts, func(i, j int) bool {
+		return strings.Count(mounts[i].path, "/") < strings.Count(mounts[j].path, "/")
+	})
+	return mounts, nil
+}
+
+// mount puts m in place under the new root
+func (m sandboxMount) mount() error {
+	target := sandboxNewRoot + m.path
+	var err error
+	switch m.kind {
+	case "tmpfs":
+		if err = os.MkdirAll(target, 0755); err == nil {
+			err = syscall.Mount("tmpfs", target, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777")
+		}
+	case "dev":
+		if err = os.MkdirAll(target, 0755); err == nil {
+			err = syscall.Mount("tmpfs", target, "tmpfs", syscall.MS_NOSUID|syscall.MS_NOEXEC, "mode=0755")
+		}
+	case "proc":
+		if err = os.MkdirAll(target, 0755); err != nil {
+			break
+		}
+		err = syscall.Mount("proc", target, "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+		if err != nil {
+			// A fresh /proc is refused where parts of the host's are masked, as in containers;
+			// the host's then has to do, showing every process
+			err = bind(sandboxOldRoot+"/proc", target)
+		}
+	case "bind":
+		err = bind(sandboxOldRoot+m.source, target)
+	}
+	if err != nil {
+		return fmt.Errorf("mounting %s: %w", m.path, err)
+	}
+	return nil
+}
+
+// bind mounts source, with everything mounted below it, at target, creating target as a file
+// or directory to match source
+func bind(source string, target string) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		err = os.MkdirAll(target, 0755)
+	} else if err = os.MkdirAll(filepath.Dir(target), 0755); err == nil {
+		var f *os.File
+		if f, err = os.OpenFile(target, os.O_CREATE|os.O_WRONLY, 0644); err == nil {
+			f.Close()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return syscall.Mount(source, target, "", syscall.MS_BIND|syscall.MS_REC, "")
+}
+
+// devices fills the sandbox's /dev with the host's harmless devices
+func devices() error {
+	dev := sandboxNewRoot + "/dev"
+	for _, name := range []string{"null", "zero", "full", "random", "urandom", "tty"} {
+		if err := bind(sandboxOldRoot+"/dev/"+name, dev+"/"+name); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("mounting /dev/%s: %w", name, err)
+		}
+	}
+	links := map[string]string{"fd": "/proc/self/fd", "stdin": "/proc/self/fd/0", "stdout": "/proc/self/fd/1", "stderr": "/proc/self/fd/2"}
+	for name, target := range links {
+		if err := os.Symlink(target, dev+"/"+name); err != nil {
+			return err
+		}
+	}
+	// Python's multiprocessing needs a shared memory mount for its locks
+	if err := os.Mkdir(dev+"/shm", 01777); err != nil {
+		return err
+	}
+	return syscall.Mount("tmpfs", dev+"/shm", "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777")
+}
+
+// remountReadOnly makes every mount under the new root read-only, except the ones that are
+// writable by design. Binds are recursive, so this goes by the mount table to catch the mounts
+// below the binds as well. Each mount belongs to the deepest sandbox mount it lies in.
+func remountReadOnly(mounts []sandboxMount) error {
+	mountTable, err := readMountTable()
+	if err != nil {
+		return err
+	}
+	for _, entry := range mountTable {
+		path := entry.path
+		if path != sandboxNewRoot && !strings.HasPrefix(path, sandboxNewRoot+"/") {
+			continue
+		}
+		inner := strings.TrimPrefix(path, sandboxNewRoot)
+		writable := false
+		depth := -1
+		for _, m := range mounts {
+			if (inner == m.path || strings.HasPrefix(inner, m.path+"/")) && len(m.path) > depth {
+				writable, depth = m.writable, len(m.path)
+			}
+		}
+		if writable {
+			continue
+		}
+		// A user namespace cannot clear flags the host mounted with, so keep those
+		flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY | syscall.MS_NOSUID | syscall.MS_NODEV)
+		for _, option := range strings.Split(entry.options, ",") {
+			switch option {
+			case "noexec":
+				flags |= syscall.MS_NOEXEC
+			case "noatime":
+				flags |= syscall.MS_NOATIME
+			case "nodiratime":
+				flags |= syscall.MS_NODIRATIME
+			case "relatime":
+				flags |= syscall.MS_RELATIME
+			case "strictatime":
+				flags |= syscall.MS_STRICTATIME
+			}
+		}
+		if err := syscall.Mount("", path, "", flags, ""); err != nil {
+			return fmt.Errorf("making %s read-only: %w", inner, err)
+		}
+	}
+	return nil
+}
+
+type mountTableEntry struct {
+	path    string
+	options string
+}
+
+// readMountTable returns the mount points of the launcher's mount namespace in mount order
+func readMountTable() ([]mountTableEntry, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		// /proc is the old root's until the switch
+		if f, err = os.Open(sandboxOldRoot + "/proc/self/mountinfo"); err != nil {
+			return nil, err
+		}
+	}
+	defer f.Close()
+
+	var entries []mountTableEntry
+	unescape := strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			continue
+		}
+		entries = append(entries, mountTableEntry{path: unescape.Replace(fields[4]), options: fields[5]})
+	}
+	return entries, scanner.Err()
+}
+
+// loopbackUp brings up the loopback interface of a new network namespace, which starts down
+func loopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	var req struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(req.name[:], "lo")
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		return errno
+	}
+	req.flags |= syscall.IFF_UP
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// dropCapabilities leaves the thread, and the command it execs, without capabilities for good:
+// none in the bounding set to regain on exec, none ambient or inheritable, and no setuid
+func dropCapabilities() error {
+	for c := 0; c <= capLastValid; c++ {
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_CAPBSET_DROP, uintptr(c), 0); errno == syscall.EINVAL {
+			break
+		} else if errno != 0 {
+			return fmt.Errorf("dropping capability %d: %w", c, errno)
+		}
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prCapAmbient, prCapAmbientClearAll, 0); errno != 0 {
+		return fmt.Errorf("clearing ambient capabilities: %w", errno)
+	}
+	header := struct {
+		version uint32
+		pid     int32
+	}{version: linuxCapabilityVersion3}
+	var data [2]struct{ effective, permitted, inheritable uint32 }
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("clearing capabilities: %w", errno)
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return fmt.Errorf("setting no_new_privs: %w", errno)
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package api
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// errNoSandbox is returned when a sandbox is asked for where namespaces do not exist
+var errNoSandbox = errors.New("the sandbox needs Linux namespaces")
+
+func isolate(cmd *exec.Cmd, isolateNetwork bool) error {
+	return errNoSandbox
+}
+
+func enterSandbox(spec sandboxSpec) error {
+	return errNoSandbox
+}
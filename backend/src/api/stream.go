@@ -0,0 +1,293 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	streamFlushInterval = 50 * time.Millisecond
+	streamFlushSize     = 16 * 1024
+)
+
+// outputStream coalesces stdout/stderr chunks of a running execution and forwards them to the
+// client as stream messages, at most every streamFlushInterval per stream so that a tight print
+// loop does not turn into one WebSocket message per line.
+//
+// Past the server's output limit nothing more is sent inline. The output goes to a file in the
+// session's output directory instead, and Close sends its last part with a link to the file.
+// Display bundles count against the same limit; those past it are left out, with a line in
+// the file saying so.
+type outputStream struct {
+	client  *Client
+	req     WebSocketMessage
+	msgType string
+
+	mu      sync.Mutex
+	buffers map[string][]byte
+	order   []string
+	timer   *time.Timer
+
+	// limit is the server's OutputLimit, zero for none. Three quarters of it go to the head,
+	// sent as it comes, and a quarter to the tail, sent by Close.
+	limit int64
+	// head is the output sent inline so far, kept to start the spill file with, and displayed
+	// the size of the display bundles sent inline
+	head      []byte
+	displayed int64
+	truncated bool
+	// spill receives all of the output once it is truncated; it is nil if it could not be
+	// created or written
+	spill *os.File
+	// tail holds the latest output once it is truncated; total counts all of it
+	tail  []byte
+	total int64
+}
+
+func newOutputStream(client *Client, req WebSocketMessage, msgType string) *outputStream {
+	return &outputStream{
+		client:  client,
+		req:     req,
+		msgType: msgType,
+		buffers: make(map[string][]byte),
+		limit:   getServerConfig().OutputLimit,
+	}
+}
+
+// Write appends a chunk for the named stream ("stdout" or "stderr")
+func (s *outputStream) Write(name string, p []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.total += int64(len(p))
+	if s.limit > 0 {
+		if p = s.limitLocked(p); len(p) == 0 {
+			return
+		}
+	}
+	if _, ok := s.buffers[name]; !ok {
+		s.order = append(s.order, name)
+	}
+	s.buffers[name] = append(s.buffers[name], p...)
+
+	if len(s.buffers[name]) >= streamFlushSize {
+		s.flushLocked(false)
+		return
+	}
+	if s.timer == nil {
+		s.timer = time.AfterFunc(streamFlushInterval, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.timer = nil
+			s.flushLocked(false)
+		})
+	}
+}
+
+// Writer returns an io.Writer that feeds the named stream
+func (s *outputStream) Writer(name string) *streamWriter {
+	return &streamWriter{stream: s, name: name}
+}
+
+// Flush sends everything that is still buffered, including incomplete UTF-8 sequences
+func (s *outputStream) Flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.flushLocked(true)
+}
+
+// Display sends a display_data message with a MIME bundle, after the output written before it.
+// A bundle that does not fit in what is left of the output limit is not sent.
+func (s *outputStream) Display(data, metadata map[string]interface{}) {
+	s.Flush()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.limit > 0 {
+		size := bundleSize(data, metadata)
+		s.total += size
+		if s.truncated || size > s.roomLocked() {
+			s.omitDisplayLocked(data, size)
+			return
+		}
+		s.displayed += size
+	}
+	s.client.reply(s.req, WebSocketMessage{Type: "display_data", Data: data, Metadata: metadata})
+}
+
+// Close flushes the stream. If the output went over the limit it then sends an output_truncated
+// message with the end of the output, its size, how much of it was left out and the URL of a
+// file with all of it.
+func (s *outputStream) Close() {
+	s.Flush()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.truncated {
+		return
+	}
+	tail := s.tail
+	if n := int(s.limit / 4); len(tail) > n {
+		tail = tail[len(tail)-n:]
+	}
+	for len(tail) > 0 && !utf8.RuneStart(tail[0]) {
+		tail = tail[1:]
+	}
+	msg := WebSocketMessage{
+		Type:    "output_truncated",
+		Content: string(tail),
+		Size:    s.total,
+		Omitted: s.total - int64(len(s.head)) - s.displayed - int64(len(tail)),
+	}
+	if s.spill != nil {
+		if err := s.spill.Close(); err != nil {
+			log.Printf("Error writing output file: %v", err)
+		} else {
+			msg.URL = s.client.publishOutputFile(s.spill.Name())
+		}
+		s.spill = nil
+	}
+	s.client.reply(s.req, msg)
+}
+
+// limitLocked returns the part of p that is still sent inline. The rest goes to the spill file
+// and the tail.
+func (s *outputStream) limitLocked(p []byte) []byte {
+	if !s.truncated {
+		room := int(s.roomLocked())
+		if len(p) <= room {
+			s.head = append(s.head, p...)
+			return p
+		}
+		inline := p[:completeUTF8Prefix(p[:room])]
+		s.truncated = true
+		s.startSpill()
+		s.spillLocked(p)
+		s.head = append(s.head, inline...)
+		s.keepTail(p[len(inline):])
+		return inline
+	}
+	s.spillLocked(p)
+	s.keepTail(p)
+	return nil
+}
+
+// roomLocked returns how much more output fits in the head
+func (s *outputStream) roomLocked() int64 {
+	return s.limit - s.limit/4 - int64(len(s.head)) - s.displayed
+}
+
+// omitDisplayLocked truncates the output at a display bundle that is not sent, noting it in
+// the spill file
+func (s *outputStream) omitDisplayLocked(data map[string]interface{}, size int64) {
+	if !s.truncated {
+		s.truncated = true
+		s.startSpill()
+	}
+	mimeTypes := make([]string, 0, len(data))
+	for mimeType := range data {
+		mimeTypes = append(mimeTypes, mimeType)
+	}
+	sort.Strings(mimeTypes)
+	s.spillLocked([]byte(fmt.Sprintf("[display of %s left out, %d bytes]\n", strings.Join(mimeTypes, ", "), size)))
+}
+
+// bundleSize returns the size of a display bundle as it is sent
+func bundleSize(data, metadata map[string]interface{}) int64 {
+	size := int64(0)
+	for _, part := range []map[string]interface{}{data, metadata} {
+		if len(part) == 0 {
+			continue
+		}
+		if encoded, err := json.Marshal(part); err == nil {
+			size += int64(len(encoded))
+		}
+	}
+	return size
+}
+
+// startSpill creates the spill file and writes the head to it
+func (s *outputStream) startSpill() {
+	file, err := s.client.createOutputFile()
+	if err != nil {
+		log.Printf("Error creating output file: %v", err)
+		return
+	}
+	s.spill = file
+	s.spillLocked(s.head)
+}
+
+func (s *outputStream) spillLocked(p []byte) {
+	if s.spill == nil {
+		return
+	}
+	if _, err := s.spill.Write(p); err != nil {
+		log.Printf("Error writing output file: %v", err)
+		s.spill.Close()
+		os.Remove(s.spill.Name())
+		s.spill = nil
+	}
+}
+
+// keepTail appends p to the tail, dropping what is too old to ever be sent
+func (s *outputStream) keepTail(p []byte) {
+	n := int(s.limit / 4)
+	if len(p) > n {
+		p = p[len(p)-n:]
+	}
+	s.tail = append(s.tail, p...)
+	if len(s.tail) > 2*n {
+		s.tail = append([]byte(nil), s.tail[len(s.tail)-n:]...)
+	}
+}
+
+func (s *outputStream) flushLocked(final bool) {
+	for _, name := range s.order {
+		buf := s.buffers[name]
+		n := len(buf)
+		if !final {
+			n = completeUTF8Prefix(buf)
+		}
+		if n == 0 {
+			continue
+		}
+		s.client.reply(s.req, WebSocketMessage{Type: s.msgType, Name: name, Content: string(buf[:n])})
+		s.buffers[name] = append(buf[:0:0], buf[n:]...)
+	}
+}
+
+// completeUTF8Prefix returns the length of buf without a trailing partial UTF-8 sequence,
+// so that a multi-byte character split across two reads is not sent as two broken halves
+func completeUTF8Prefix(buf []byte) int {
+	for i := len(buf) - 1; i >= 0 && i >= len(buf)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(buf[i]) {
+			if utf8.FullRune(buf[i:]) {
+				return len(buf)
+			}
+			return i
+		}
+	}
+	return len(buf)
+}
+
+type streamWriter struct {
+	stream *outputStream
+	name   string
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	w.stream.Write(w.name, p)
+	return len(p), nil
+}
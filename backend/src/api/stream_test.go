@@ -0,0 +1,102 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompleteUTF8Prefix(t *testing.T) {
+	tests := []struct {
+		name string
+		buf  string
+		want int
+	}{
+		{"empty", "", 0},
+		{"ascii", "hello", 5},
+		{"complete two bytes", "café", 5},
+		{"complete three bytes", "1 €", 5},
+		{"complete four bytes", "ok \U0001F600", 7},
+		{"first byte of two", "caf\xc3", 3},
+		{"first byte of three", "1 \xe2", 2},
+		{"two bytes of three", "1 \xe2\x82", 2},
+		{"first byte of four", "ok \xf0", 3},
+		{"two bytes of four", "ok \xf0\x9f", 3},
+		{"three bytes of four", "ok \xf0\x9f\x98", 3},
+		{"only a partial rune", "\xf0\x9f\x98", 0},
+		{"stray continuation bytes", "a\x80\x80\x80\x80", 5},
+		{"invalid start byte", "a\xff", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := completeUTF8Prefix([]byte(tt.buf)); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDisplayOutputLimit(t *testing.T) {
+	c := &Client{
+		send:    make(chan []byte, 16),
+		done:    make(chan struct{}),
+		workdir: t.TempDir(),
+	}
+	defer c.removeOutputFiles()
+	req := WebSocketMessage{Type: "python", MsgID: "cell"}
+	stream := &outputStream{client: c, req: req, msgType: "python_stream", buffers: map[string][]byte{}, limit: 1000}
+
+	small := map[string]interface{}{"text/plain": "small"}
+	large := map[string]interface{}{"image/png": strings.Repeat("A", 1000), "text/plain": "<Figure>"}
+	stream.Write("stdout", []byte("before\n"))
+	stream.Display(small, nil)
+	stream.Display(large, nil)
+	stream.Write("stdout", []byte("after\n"))
+	stream.Display(small, nil)
+	stream.Close()
+
+	var replies []WebSocketMessage
+	for len(c.send) > 0 {
+		var msg WebSocketMessage
+		if err := json.Unmarshal(<-c.send, &msg); err != nil {
+			t.Fatal(err)
+		}
+		replies = append(replies, msg)
+	}
+	var types []string
+	for _, msg := range replies {
+		types = append(types, msg.Type)
+	}
+	if got, want := strings.Join(types, " "), "python_stream display_data output_truncated"; got != want {
+		t.Fatalf("got messages %s, want %s", got, want)
+	}
+
+	truncated := replies[2]
+	wantSize := int64(len("before\n")+len("after\n")) + 2*bundleSize(small, nil) + bundleSize(large, nil)
+	if truncated.Size != wantSize {
+		t.Errorf("got size %d, want %d", truncated.Size, wantSize)
+	}
+	if truncated.Content != "after\n" {
+		t.Errorf("got tail %q, want %q", truncated.Content, "after\n")
+	}
+	if want := bundleSize(small, nil) + bundleSize(large, nil); truncated.Omitted != want {
+		t.Errorf("got %d bytes omitted, want %d", truncated.Omitted, want)
+	}
+
+	files, err := os.ReadDir(c.outputDir)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("got output files %v, %v; want one", files, err)
+	}
+	spilled, err := os.ReadFile(filepath.Join(c.outputDir, files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("before\n[display of image/png, text/plain left out, %d bytes]\nafter\n[display of text/plain left out, %d bytes]\n",
+		bundleSize(large, nil), bundleSize(small, nil))
+	if string(spilled) != want {
+		t.Errorf("got output file %q, want %q", spilled, want)
+	}
+}
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	// inspectTimeout bounds how long the kernel may take to answer the variable inspector or a
+	// completion or documentation request
+	inspectTimeout      = 10 * time.Second
+	defaultVariablePage = 50
+	maxVariablePage     = 1000
+)
+
+// VariableSummary describes one user-visible global of the kernel namespace
+type VariableSummary struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Shape is set for arrays, dataframes and tensors, Size for other objects that have a length
+	Shape []int `json:"shape,omitempty"`
+	Size  *int  `json:"size,omitempty"`
+	// Repr is the variable's repr on one line, shortened
+	Repr string `json:"repr"`
+}
+
+// VariableDetail is one page of the contents of a dataframe, series, array, dict, list or
+// tuple, laid out as a table of shortened reprs
+type VariableDetail struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Kind is "dataframe", "series", "array", "dict" or "sequence"
+	Kind  string `json:"kind"`
+	Shape []int  `json:"shape,omitempty"`
+	// Dtypes holds the dtype of every column of a dataframe, or the dtype of an array or series
+	Dtypes []string `json:"dtypes,omitempty"`
+	// Total is the number of rows, of which the page starts at Offset
+	Total  int `json:"total"`
+	Offset int `json:"offset"`
+	// Columns names the columns of Rows; HiddenColumns counts those left out of a wide table
+	Columns       []string `json:"columns"`
+	HiddenColumns int      `json:"hidden_columns,omitempty"`
+	// Index labels the rows: dataframe index labels, positions or dict keys
+	Index []string   `json:"index"`
+	Rows  [][]string `json:"rows"`
+}
+
+// variableRequest is the content of an inspect_variable request
+type variableRequest struct {
+	Name   string `json:"name"`
+	Offset int    `json:"offset"`
+	Limit  int    `json:"limit"`
+}
+
+// inspectableKernel returns the session kernel if it can answer the inspector or the editor now.
+// A session without a kernel has no variables; none is started for it. A kernel running a cell would
+// only answer once the cell is done, so it is reported busy instead.
+func (c *Client) inspectableKernel(req WebSocketMessage, replyType string) (Kernel, bool) {
+	c.kernelMu.Lock()
+	kernel := c.kernel
+	c.kernelMu.Unlock()
+	if kernel == nil || !kernel.Alive() {
+		return nil, true
+	}
+	if c.kernelBusy() {
+		c.sendDone(req, replyType, "busy", "The kernel is running a cell")
+		return nil, false
+	}
+	return kernel, true
+}
+
+// kernelBusy reports whether a cell is running in the session kernel
+func (c *Client) kernelBusy() bool {
+	c.runningMu.Lock()
+	defer c.runningMu.Unlock()
+	for e := range c.running {
+		if e.kind == "python" {
+			return true
+		}
+	}
+	return false
+}
+
+// inspectVariables answers an inspect_variables request with a JSON list of VariableSummary
+func (c *Client) inspectVariables(req WebSocketMessage) {
+	kernel, ok := c.inspectableKernel(req, "variables")
+	if !ok {
+		return
+	}
+	variables := []VariableSummary{}
+	if kernel != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), inspectTimeout)
+		defer cancel()
+		found, err := kernel.Variables(ctx)
+		if err != nil {
+			c.sendDone(req, "variables", "error", fmt.Sprintf("Error: %v", err))
+			return
+		}
+		if found != nil {
+			variables = found
+		}
+	}
+	c.sendJSON(req, "variables", variables)
+}
+
+// inspectVariable answers an inspect_variable request, whose content is a JSON variableRequest,
+// with a page of the variable as a JSON VariableDetail
+func (c *Client) inspectVariable(req WebSocketMessage) {
+	var request variableRequest
+	if err := json.Unmarshal([]byte(req.Content), &request); err != nil || request.Name == "" {
+		c.sendDone(req, "variable", "error", "Error: inspect_variable needs a variable name")
+		return
+	}
+	if request.Offset < 0 {
+		request.Offset = 0
+	}
+	if request.Limit <= 0 {
+		request.Limit = defaultVariablePage
+	}
+	if request.Limit > maxVariablePage {
+		request.Limit = maxVariablePage
+	}
+
+	kernel, ok := c.inspectableKernel(req, "variable")
+	if !ok {
+		return
+	}
+	if kernel == nil {
+		c.sendDone(req, "variable", "error", fmt.Sprintf("Error: name %q is not defined", request.Name))
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), inspectTimeout)
+	defer cancel()
+	detail, err := kernel.Variable(ctx, request.Name, request.Offset, request.Limit)
+	if err != nil {
+		c.sendDone(req, "variable", "error", fmt.Sprintf("Error: %v", err))
+		return
+	}
+	c.sendJSON(req, "variable", detail)
+}
@@ -0,0 +1,121 @@
+package api
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// workspace returns the session's workspace, the working directory of its kernel and shell
+// commands
+func (c *Client) workspace() string {
+	c.kernelMu.Lock()
+	defer c.kernelMu.Unlock()
+	return c.workspaceLocked()
+}
+
+func (c *Client) workspaceLocked() string {
+	if c.workdir != "" {
+		return c.workdir
+	}
+	return defaultWorkspace()
+}
+
+// defaultWorkspace is the workspace of sessions that have not set one: PYSYNC_WORKSPACE, or
+// else the directory the server was started in, which is where the notebook is
+func defaultWorkspace() string {
+	dir := getServerConfig().Workspace
+	if dir == "" {
+		var err error
+		if dir, err = os.Getwd(); err != nil {
+			return os.TempDir()
+		}
+	}
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	return dir
+}
+
+// resolveWorkspace turns the path of a set_workspace request into a directory under root, the
+// default workspace. A relative path is taken from root, and a file, such as the notebook
+// itself, stands for the directory it is in. A missing directory is created if its parent
+// exists. The home directory and the directories above it are refused: the sandbox would mount
+// them writable over the empty home it gives every execution.
+func resolveWorkspace(path, root string) (string, error) {
+	root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(root, path)
+	}
+	path = filepath.Clean(path)
+
+	info, err := os.Stat(path)
+	create := false
+	switch {
+	case err == nil && !info.IsDir():
+		path = filepath.Dir(path)
+	case os.IsNotExist(err):
+		create = true
+	case err != nil:
+		return "", err
+	}
+	// Symlinks are resolved so that none of them leads out of root; a missing directory is
+	// checked through its parent
+	dir, name := path, ""
+	if create {
+		dir, name = filepath.Split(path)
+	}
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	resolved := filepath.Join(dir, name)
+
+	if resolved != root && !strings.HasPrefix(resolved, root+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is not inside %s", path, root)
+	}
+	if home, err := os.UserHomeDir(); err == nil && filepath.IsAbs(home) {
+		if resolvedHome, err := filepath.EvalSymlinks(home); err == nil {
+			home = resolvedHome
+		}
+		if resolved == home || strings.HasPrefix(home, resolved+string(filepath.Separator)) {
+			return "", fmt.Errorf("%s contains the home directory", path)
+		}
+	}
+	if create {
+		if err := os.Mkdir(resolved, 0755); err != nil {
+			return "", err
+		}
+	}
+	return resolved, nil
+}
+
+// setWorkspace handles a set_workspace request, whose content is the workspace directory or the
+// path of the notebook, either of them under the default workspace; empty content goes back to
+// the default. A running kernel is shut down
+// so that the next cell starts in the new workspace. The reply carries the directory.
+func (c *Client) setWorkspace(req WebSocketMessage) {
+	var dir string
+	if path := strings.TrimSpace(req.Content); path != "" {
+		var err error
+		if dir, err = resolveWorkspace(path, defaultWorkspace()); err != nil {
+			c.sendDone(req, "workspace", "error", fmt.Sprintf("Error: invalid workspace: %v", err))
+			return
+		}
+	}
+
+	c.kernelMu.Lock()
+	previous := c.workspaceLocked()
+	c.workdir = dir
+	current := c.workspaceLocked()
+	if current != previous && c.kernel != nil {
+		c.closeKernelLocked()
+	}
+	c.kernelMu.Unlock()
+
+	c.sendDone(req, "workspace", "ok", current)
+}
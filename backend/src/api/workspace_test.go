@@ -0,0 +1,69 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveWorkspace(t *testing.T) {
+	base, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(base, "root")
+	outside := filepath.Join(base, "outside")
+	// The home directory is usually outside the root; rootHome is one inside it
+	home := filepath.Join(base, "home")
+	rootHome := filepath.Join(root, "home", "user")
+	for _, dir := range []string{filepath.Join(root, "project"), outside, home, rootHome} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "project", "notebook.py"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		path    string
+		home    string
+		want    string
+		wantErr bool
+	}{
+		{"root", root, home, root, false},
+		{"existing directory", filepath.Join(root, "project"), home, filepath.Join(root, "project"), false},
+		{"relative to the root", "project", home, filepath.Join(root, "project"), false},
+		{"notebook", filepath.Join(root, "project", "notebook.py"), home, filepath.Join(root, "project"), false},
+		{"created", filepath.Join(root, "project", "new"), home, filepath.Join(root, "project", "new"), false},
+		{"missing parent", filepath.Join(root, "missing", "new"), home, "", true},
+		{"outside the root", outside, home, "", true},
+		{"parent of the root", base, home, "", true},
+		{"dot dot", "../outside", home, "", true},
+		{"through a symlink", filepath.Join(root, "escape"), home, "", true},
+		{"created through a symlink", filepath.Join(root, "escape", "new"), home, "", true},
+		{"home", rootHome, rootHome, "", true},
+		{"parent of home", filepath.Join(root, "home"), rootHome, "", true},
+		{"root above home", root, rootHome, "", true},
+		{"home outside the root", home, home, "", true},
+		{"created outside the root", filepath.Join(outside, "new"), home, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("HOME", tt.home)
+			got, err := resolveWorkspace(tt.path, root)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if _, err := os.Stat(filepath.Join(outside, "new")); !os.IsNotExist(err) {
+		t.Errorf("a directory was created outside the root: %v", err)
+	}
+}
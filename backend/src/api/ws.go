@@ -1,18 +1,18 @@
 package api
 
 import (
-	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
 	"os/user"
-	"path/filepath"
 	"runtime"
-	"strings"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
@@ -31,23 +31,131 @@ const (
 	pongWait       = 60 * time.Second
 	pingPeriod     = (pongWait * 9) / 10
 	maxMessageSize = 512 * 1024
-	execTimeout    = 30 * time.Second
 )
 
 type Client struct {
 	conn *websocket.Conn
 	send chan []byte
+	// done is closed once the connection is gone so that senders stop waiting on send
+	done chan struct{}
+
+	// kernel is the session's Python kernel, started on first use with the session's
+	// interpreter, or the server default when the session has not selected one
+	kernelMu   sync.Mutex
+	kernel     Kernel
+	pythonPath string
+	// limits are the resource limits the session asked for, capped by the server's
+	limits ResourceLimits
+	// sandbox holds the sandbox options the session asked for, nil until it does
+	sandbox *SandboxOptions
+	// workdir is the workspace the session set, "" for the default
+	workdir string
+
+	// restartPolicy is the restart policy the session set, nil for the server's; autoRestarts
+	// counts the kernel's automatic restarts since a cell last ran to the end
+	restartPolicy *RestartPolicy
+	autoRestarts  int
+	// stoppedKernel is the session kernel while the backend kills it, for a timeout or a kill
+	// request, so that its death is not reported as a crash
+	stoppedKernel Kernel
+
+	// kernelStatus is the state of the session kernel last sent to the client, one of the
+	// Kernel* constants, "" before the first kernel starts
+	statusMu     sync.Mutex
+	kernelStatus string
+
+	// queue runs the session's python, shell and pip requests one at a time
+	queue *executionQueue
+
+	// metrics holds the metrics of the running execution by request msg_id; executionCount
+	// numbers the session's executions
+	metricsMu      sync.Mutex
+	metrics        map[string]*ExecutionMetrics
+	executionCount int
+
+	// running holds the executions that interrupt and kill messages apply to
+	runningMu sync.Mutex
+	running   map[*execution]struct{}
+
+	// outputDir holds the full output of the session's truncated executions; outputTokens are
+	// the download tokens of those files
+	outputMu     sync.Mutex
+	outputDir    string
+	outputTokens []string
+
+	// debugDir holds the files cells run from once a debugger is started; debugToken is the
+	// token of the session's debug socket
+	debugMu    sync.Mutex
+	debugDir   string
+	debugToken string
+
+	// inputRequest is the msg_id of the input_request a cell is blocked on, if any
+	inputMu      sync.Mutex
+	inputRequest string
 }
 
 type WebSocketMessage struct {
 	Type    string `json:"type"`
 	Content string `json:"content"`
+	// MsgID identifies a message. Clients set it on requests; the server sets it on everything it sends.
+	MsgID string `json:"msg_id,omitempty"`
+	// ParentID is the MsgID of the request a server message answers. On interrupt and kill
+	// requests it names the execution to stop; when empty every running execution is stopped.
+	ParentID string `json:"parent_id,omitempty"`
+	// CellID is the notebook cell a request came from, echoed back on every message it causes
+	CellID string `json:"cell_id,omitempty"`
+	// Name is the stream ("stdout" or "stderr") of a python_stream, shell_stream or pip_stream message
+	Name string `json:"name,omitempty"`
+	// Status is the outcome ("ok", "error", "timeout", ...) of a done message or other reply
+	Status string `json:"status,omitempty"`
+	// Data is the MIME bundle of a display_data message, keyed by MIME type ("text/plain",
+	// "text/html", "image/png", ...). Binary formats are base64 encoded.
+	Data map[string]interface{} `json:"data,omitempty"`
+	// Metadata holds per-MIME-type display hints of a display_data message, such as image sizes
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+	// Timeout is the time limit in seconds a python or shell request asks for; 0 means no
+	// limit. When absent the server default applies. Either way the server maximum caps it.
+	Timeout *float64 `json:"timeout,omitempty"`
+	// Profile runs a python request under cProfile, and ProfileMemory under tracemalloc as
+	// well. The report comes in a python_profile message ahead of python_done.
+	Profile       bool `json:"profile,omitempty"`
+	ProfileMemory bool `json:"profile_memory,omitempty"`
+	// Limit names the resource limit (a ResourceLimits field such as "cpu_seconds") that stopped
+	// an execution whose status is "limit_exceeded"
+	Limit string `json:"limit,omitempty"`
+	// Password marks an input_request whose answer should not be echoed, as for getpass
+	Password bool `json:"password,omitempty"`
+	// Position is the place, counting from 1, of a queued request in the session's queue
+	Position int `json:"position,omitempty"`
+	// Ename, Evalue and Traceback describe the exception of a python_error message. Traceback
+	// lists the frames innermost last; it is empty for Jupyter kernels, which send formatted text.
+	Ename     string           `json:"ename,omitempty"`
+	Evalue    string           `json:"evalue,omitempty"`
+	Traceback []TracebackFrame `json:"traceback,omitempty"`
+	// ExitCode is the exit status of a shell command, of a kernel that died, or the one a cell
+	// raising SystemExit asked for
+	ExitCode *int `json:"exit_code,omitempty"`
+	// Signal names the signal that killed the kernel of a kernel_died message, e.g. "SIGSEGV"
+	Signal string `json:"signal,omitempty"`
+	// URL, Size and Omitted describe an output_truncated message: where to download the full
+	// output, its size in bytes and how many of them were not sent inline
+	URL     string `json:"url,omitempty"`
+	Size    int64  `json:"size,omitempty"`
+	Omitted int64  `json:"omitted,omitempty"`
+	// ExecutionMetrics are set on the python_done, shell_done and pip_done of requests that ran
+	*ExecutionMetrics
 }
 
 func (c *Client) readPump(cancel context.CancelFunc) {
 	defer func() {
 		cancel()
+		close(c.done)
 		c.conn.Close()
+		// Nobody is left to read the output of anything still running
+		c.signalExecutions(WebSocketMessage{}, syscall.SIGKILL)
+		c.shutdownKernel()
+		c.removeOutputFiles()
+		c.removeDebugger()
 	}()
 
 	c.conn.SetReadLimit(maxMessageSize)
@@ -69,7 +177,8 @@ func (c *Client) readPump(cancel context.CancelFunc) {
 		log.Printf("Received message: %s", string(message))
 
 		if string(message) == "ping" {
-			c.conn.WriteMessage(websocket.TextMessage, []byte("pong"))
+			// Replies go through writePump; the connection allows only one concurrent writer
+			c.sendRaw([]byte("pong"))
 			continue
 		}
 
@@ -80,14 +189,57 @@ func (c *Client) readPump(cancel context.CancelFunc) {
 		}
 
 		switch msg.Type {
-		case "python":
-			go executePythonCode([]byte(msg.Content), c.send)
-		case "shell":
-			go executeShellCommand(msg.Content, c.send)
 		case "env_info":
-			go sendEnvironmentInfo(c.send)
+			go c.sendEnvironmentInfo(msg)
+		case "list_interpreters":
+			go c.listInterpreters(msg)
+		case "select_interpreter":
+			go c.selectInterpreter(msg)
+		case "pip_list":
+			go c.sendPackageList(msg)
+		case "set_limits":
+			go c.setLimits(msg)
+		case "set_sandbox":
+			go c.setSandbox(msg)
+		case "set_workspace":
+			go c.setWorkspace(msg)
+		case "inspect_variables":
+			go c.inspectVariables(msg)
+		case "inspect_variable":
+			go c.inspectVariable(msg)
+		case "complete_request":
+			go c.complete(msg)
+		case "inspect_request":
+			go c.inspect(msg)
+		case "start_debugger":
+			go c.startDebugger(msg)
+		case "kernel_restart":
+			go c.restartKernel(msg)
+		case "kernel_shutdown":
+			go c.shutdownKernelRequest(msg)
+		case "set_restart_policy":
+			go c.setRestartPolicy(msg)
+		case "kernel_status":
+			go c.sendKernelStatus(msg)
+		case "interrupt":
+			c.signalExecutions(msg, syscall.SIGINT)
+		case "kill":
+			c.signalExecutions(msg, syscall.SIGKILL)
+		case "input_reply":
+			go c.sendInput(msg)
+		case "cancel":
+			c.cancelQueued(msg)
+		case "reorder_queue":
+			c.reorderQueue(msg)
+		case "queue_status":
+			c.sendQueue(msg, "queue")
 		default:
-			log.Printf("Unsupported message type: %s", msg.Type)
+			// python, shell, pip and the other languages go to their executors
+			if executor, ok := lookupExecutor(msg.Type); ok {
+				c.enqueue(msg, executor.DoneType(), func(req WebSocketMessage) { executor.Execute(c, req) })
+			} else {
+				log.Printf("Unsupported message type: %s", msg.Type)
+			}
 		}
 	}
 }
@@ -133,148 +285,227 @@ func WebSocketV1(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	client := &Client{conn: conn, send: make(chan []byte, 256)}
+	client := &Client{conn: conn, send: make(chan []byte, 256), done: make(chan struct{}), queue: newExecutionQueue()}
 	ctx, cancel := context.WithCancel(context.Background())
 
 	go client.writePump(cancel)
 	go client.readPump(cancel)
+	go client.runQueue()
 
 	<-ctx.Done()
 }
 
-var (
-	pythonPath     string
-	pythonPathOnce sync.Once
-)
+// getKernel returns the session kernel, starting a new one if none is running
+func (c *Client) getKernel() (Kernel, error) {
+	c.kernelMu.Lock()
+	defer c.kernelMu.Unlock()
 
-func getPythonPath() string {
-	pythonPathOnce.Do(func() {
-		path, err := exec.LookPath("python3")
-		if err != nil {
-			path, err = exec.LookPath("python")
-			if err != nil {
-				log.Fatal("Python interpreter not found")
-			}
+	if c.kernel != nil && c.kernel.Alive() {
+		return c.kernel, nil
+	}
+	if c.kernel != nil {
+		// Reported here when the next request comes before watchKernel gets to it
+		c.kernelExitedLocked(c.kernel)
+	}
+	return c.startKernelLocked()
+}
+
+// startKernelLocked starts a new session kernel, reporting it starting and then idle, and
+// watches it so that its exit is reported too
+func (c *Client) startKernelLocked() (Kernel, error) {
+	// A kernel the backend stopped is no longer the session's, whether or not its exit has been
+	// seen yet; nothing about the new kernel may be taken for it
+	c.kernel = nil
+	c.stoppedKernel = nil
+	c.setKernelStatus(KernelStarting, "")
+	pythonPath := c.pythonPath
+	if pythonPath == "" {
+		var err error
+		if pythonPath, err = getPythonPath(); err != nil {
+			c.setKernelStatus(KernelDead, fmt.Sprintf("Error: %v", err))
+			return nil, err
 		}
-		pythonPath = path
-	})
-	return pythonPath
+	}
+	kernel, err := startKernel(getServerConfig().Kernel, pythonPath, c.processOptionsLocked())
+	if err != nil {
+		c.setKernelStatus(KernelDead, fmt.Sprintf("Error: %v", err))
+		return nil, err
+	}
+	c.kernel = kernel
+	c.setKernelStatus(KernelIdle, "")
+	go c.watchKernel(kernel)
+	return kernel, nil
+}
+
+// shutdownKernel stops the session kernel, if any
+func (c *Client) shutdownKernel() {
+	c.kernelMu.Lock()
+	defer c.kernelMu.Unlock()
+	c.closeKernelLocked()
 }
 
-func executePythonCode(code []byte, out chan<- []byte) {
+func (c *Client) executePythonCode(req WebSocketMessage) {
+	code := req.Content
 	defer func() {
 		if r := recover(); r != nil {
 			log.Printf("Recovered from panic in executePythonCode: %v", r)
-			sendOutput(out, "python_output", fmt.Sprintf("Error: %v", r))
+			c.sendDone(req, "python_done", "error", fmt.Sprintf("Error: %v", r))
 		}
 	}()
 
-	tmpDir, err := os.MkdirTemp("", "python_exec_")
+	limit, err := resolveTimeout(req, getServerConfig())
 	if err != nil {
-		log.Printf("Error creating temp directory: %v", err)
-		sendOutput(out, "python_output", fmt.Sprintf("Error: %v", err))
+		c.sendDone(req, "python_done", "error", fmt.Sprintf("Error: %v", err))
 		return
 	}
-	defer os.RemoveAll(tmpDir)
-
-	codePath := filepath.Join(tmpDir, fmt.Sprintf("code_%d.py", time.Now().UnixNano()))
-
-	log.Printf("Writing code to file %s: %s", codePath, string(code))
-
-	err = os.WriteFile(codePath, code, 0644)
+	kernel, err := c.getKernel()
 	if err != nil {
-		log.Printf("Error writing Python code to file: %v", err)
-		sendOutput(out, "python_output", fmt.Sprintf("Error writing code: %v", err))
+		log.Printf("Error starting Python kernel: %v", err)
+		c.sendDone(req, "python_done", "error", fmt.Sprintf("Error: %v", err))
 		return
 	}
 
-	log.Println("Running Python code")
+	log.Printf("Running Python code: %s", code)
 
-	ctx, cancel := context.WithTimeout(context.Background(), execTimeout)
+	ctx, cancel := limit.context()
 	defer cancel()
 
-	cmd := exec.CommandContext(ctx, getPythonPath(), codePath)
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-
-	if runtime.GOOS != "windows" {
-		cmd.SysProcAttr = &syscall.SysProcAttr{
-			Setpgid: true,
+	run := &execution{req: req, kind: "python", deliver: func(sig syscall.Signal) error {
+		if sig == syscall.SIGKILL {
+			c.stopKernel(kernel)
+		}
+		return kernel.Signal(sig)
+	}}
+	c.trackExecution(run)
+	defer c.untrackExecution(run)
+	c.setKernelStatus(KernelBusy, "")
+	defer c.kernelFinished(kernel)
+
+	stream := newOutputStream(c, req, "python_stream")
+	reply, err := kernel.Execute(ctx, code, executeOptions(req), func(event KernelEvent) {
+		switch event.Type {
+		case "stream":
+			stream.Write(event.Name, []byte(event.Text))
+		case "display_data", "execute_result":
+			stream.Display(event.Data, event.Metadata)
+		case "input_request":
+			stream.Flush()
+			c.requestInput(req, event)
 		}
+	})
+	stream.Close()
+	c.clearInputRequest()
+	if err == nil {
+		c.recordUsage(req, time.Duration(reply.CPUTime*float64(time.Second)), reply.PeakRSS)
 	}
-
-	if err := cmd.Start(); err != nil {
-		log.Printf("Error starting Python process: %v", err)
-		sendOutput(out, "python_output", fmt.Sprintf("Error: %v", err))
-		return
+	if err == nil && reply.Profile != nil {
+		c.sendProfile(req, reply.Profile)
 	}
-
-	done := make(chan error, 1)
-	go func() {
-		done <- cmd.Wait()
-	}()
-
-	select {
-	case <-ctx.Done():
-		if runtime.GOOS != "windows" {
-			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
-		} else {
-			cmd.Process.Kill()
-		}
-		<-done
-		sendOutput(out, "python_output", "Execution timed out")
-	case err := <-done:
-		if err != nil {
-			log.Printf("Error running Python process: %v", err)
-			sendOutput(out, "python_output", fmt.Sprintf("Error: %v\nStderr: %s", err, stderr.String()))
-			return
+	c.sendPythonError(req, run, reply, err)
+
+	// A cell that ran out of memory, files or processes usually fails with an exception;
+	// one that ran out of CPU time takes the kernel down with it
+	var exceeded string
+	if errors.Is(err, ErrKernelDied) || (err == nil && reply.Status == "error") {
+		exceeded = kernel.ExceededLimit()
+		if exceeded == "" && err == nil {
+			exceeded = c.resourceLimits().fromError(reply.Ename, reply.Errno)
 		}
 	}
 
-	output := strings.TrimSpace(stdout.String())
-	if stderr.Len() > 0 {
-		log.Printf("Python stderr: %s", stderr.String())
-		if output != "" {
-			output += "\n"
-		}
-		output += "Stderr: " + strings.TrimSpace(stderr.String())
+	switch outcome := run.outcome(); {
+	case outcome == "killed":
+		c.sendDone(req, "python_done", outcome, "Kernel was killed; its variables have been lost")
+	case outcome == "interrupted" && err == nil && reply.Status == "error":
+		c.sendDone(req, "python_done", outcome, "")
+	case exceeded != "" && err != nil:
+		c.sendLimitExceeded(req, "python_done", exceeded, "; the kernel was stopped and its variables have been lost")
+	case errors.Is(err, ErrKernelDied) && kernel.Death() != nil:
+		c.sendDone(req, "python_done", "error", kernel.Death().Description+"; its variables have been lost")
+	case errors.Is(err, context.DeadlineExceeded):
+		// The namespace is lost along with the process; the next cell starts a fresh kernel
+		c.stopKernel(kernel)
+		kernel.Kill()
+		<-kernel.Done()
+		c.sendDone(req, "python_done", "timeout", limit.message())
+	case err != nil:
+		log.Printf("Error running Python code: %v", err)
+		c.sendDone(req, "python_done", "error", fmt.Sprintf("Error: %v", err))
+	case exceeded != "":
+		c.sendLimitExceeded(req, "python_done", exceeded, "")
+	default:
+		c.sendDone(req, "python_done", reply.Status, "")
 	}
-
-	log.Printf("Python output: %s", output)
-	sendOutput(out, "python_output", output)
 	log.Println("Done with Python code execution")
 }
 
-func executeShellCommand(command string, out chan<- []byte) {
-	log.Printf("Executing shell command: %s", command)
-	ctx, cancel := context.WithTimeout(context.Background(), execTimeout)
-	defer cancel()
+// sendPythonError reports why a cell failed, ahead of its python_done: the exception it raised,
+// or the exit status of a kernel that died under it
+func (c *Client) sendPythonError(req WebSocketMessage, run *execution, reply KernelEvent, err error) {
+	var died *KernelDiedError
+	switch {
+	case err == nil && reply.Status == "error":
+		c.reply(req, WebSocketMessage{
+			Type:      "python_error",
+			Ename:     reply.Ename,
+			Evalue:    reply.Evalue,
+			Traceback: reply.Traceback,
+			ExitCode:  reply.ExitCode,
+		})
+	case errors.As(err, &died) && run.outcome() != "killed":
+		c.reply(req, WebSocketMessage{Type: "python_error", Evalue: died.Error(), ExitCode: &died.ExitCode})
+	}
+}
+
+// sendLimitExceeded ends an execution that ran into a resource limit, naming the limit
+func (c *Client) sendLimitExceeded(req WebSocketMessage, doneType string, limit string, detail string) {
+	content := fmt.Sprintf("Stopped by the %s%s", c.resourceLimits().describe(limit), detail)
+	c.sendDoneMessage(req, WebSocketMessage{Type: doneType, Status: "limit_exceeded", Limit: limit, Content: content})
+}
 
-	cmd := exec.CommandContext(ctx, "sh", "-c", command)
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+// requestInput asks the client for a line of stdin. The content is the prompt; the client
+// answers with an input_reply whose parent_id is the msg_id of the input_request.
+func (c *Client) requestInput(req WebSocketMessage, event KernelEvent) {
+	msg := WebSocketMessage{Type: "input_request", MsgID: newMessageID(), Content: event.Prompt, Password: event.Password}
+	c.inputMu.Lock()
+	c.inputRequest = msg.MsgID
+	c.inputMu.Unlock()
+	c.reply(req, msg)
+}
 
-	err := cmd.Run()
-	if err != nil {
-		log.Printf("Error executing shell command: %v", err)
-		sendOutput(out, "shell_output", fmt.Sprintf("Error: %v\nStderr: %s", err, stderr.String()))
+func (c *Client) clearInputRequest() {
+	c.inputMu.Lock()
+	c.inputRequest = ""
+	c.inputMu.Unlock()
+}
+
+// sendInput passes the content of an input_reply to the kernel. Replies that arrive when no
+// cell is waiting, or that answer an earlier input_request, are rejected.
+func (c *Client) sendInput(req WebSocketMessage) {
+	c.inputMu.Lock()
+	pending := c.inputRequest
+	if pending == "" || (req.ParentID != "" && req.ParentID != pending) {
+		c.inputMu.Unlock()
+		c.sendDone(req, "input_reply", "not_waiting", "No cell is waiting for this input")
 		return
 	}
-
-	output := strings.TrimSpace(stdout.String())
-	if stderr.Len() > 0 {
-		if output != "" {
-			output += "\n"
-		}
-		output += "Stderr: " + strings.TrimSpace(stderr.String())
+	c.inputRequest = ""
+	c.inputMu.Unlock()
+
+	c.kernelMu.Lock()
+	kernel := c.kernel
+	c.kernelMu.Unlock()
+	if kernel == nil {
+		c.sendDone(req, "input_reply", "not_waiting", "No cell is waiting for this input")
+		return
+	}
+	if err := kernel.Input(req.Content); err != nil {
+		log.Printf("Error sending input to kernel: %v", err)
+		c.sendDone(req, "input_reply", "error", fmt.Sprintf("Error: %v", err))
 	}
-	log.Printf("Shell command output: %s", output)
-	sendOutput(out, "shell_output", strings.TrimSpace(output))
 }
 
-func sendEnvironmentInfo(out chan<- []byte) {
+func (c *Client) sendEnvironmentInfo(req WebSocketMessage) {
 	currentUser, err := user.Current()
 	if err != nil {
 		log.Printf("Error getting current user: %v", err)
@@ -293,33 +524,81 @@ func sendEnvironmentInfo(out chan<- []byte) {
 		OS         string `json:"os"`
 		Username   string `json:"username"`
 		Hostname   string `json:"hostname"`
+		Workspace  string `json:"workspace"`
+		// Executors are the message types that run code, such as python, shell or node
+		Executors []string `json:"executors"`
 	}{
-		PythonPath: getPythonPath(),
+		PythonPath: c.interpreterPath(),
 		OS:         osName,
 		Username:   currentUser.Username,
 		Hostname:   hostname,
+		Workspace:  c.workspace(),
+		Executors:  executorTypes(),
 	}
 
 	jsonInfo, err := json.Marshal(info)
 	if err != nil {
 		log.Printf("Error marshaling environment info: %v", err)
-		sendOutput(out, "env_info", "Error getting environment info")
+		c.sendOutput(req, "env_info", "Error getting environment info")
 		return
 	}
 
 	log.Printf("Sending environment info: %s", string(jsonInfo))
-	sendOutput(out, "env_info", string(jsonInfo))
+	c.sendOutput(req, "env_info", string(jsonInfo))
+}
+
+func (c *Client) sendOutput(req WebSocketMessage, outputType string, content string) {
+	c.reply(req, WebSocketMessage{Type: outputType, Content: content})
 }
 
-func sendOutput(out chan<- []byte, outputType string, content string) {
-	output := WebSocketMessage{Type: outputType, Content: content}
+// sendDone reports the end of an execution
+func (c *Client) sendDone(req WebSocketMessage, doneType string, status string, content string) {
+	c.sendDoneMessage(req, WebSocketMessage{Type: doneType, Status: status, Content: content})
+}
+
+// sendDoneMessage sends the message that ends req, with the execution metrics of req if it ran
+func (c *Client) sendDoneMessage(req WebSocketMessage, msg WebSocketMessage) {
+	msg.ExecutionMetrics = c.finishExecution(req)
+	c.reply(req, msg)
+}
+
+// reply sends msg tagged with the IDs of the request that caused it
+func (c *Client) reply(req WebSocketMessage, msg WebSocketMessage) {
+	msg.ParentID = req.MsgID
+	if msg.CellID == "" {
+		msg.CellID = req.CellID
+	}
+	c.sendMessage(msg)
+}
+
+func (c *Client) sendMessage(output WebSocketMessage) {
+	if output.MsgID == "" {
+		output.MsgID = newMessageID()
+	}
 	jsonOutput, err := json.Marshal(output)
 	if err != nil {
 		log.Printf("Error marshaling output: %v", err)
 		return
 	}
 	log.Printf("Sending output: %s", string(jsonOutput))
-	out <- jsonOutput
+	c.sendRaw(jsonOutput)
+}
+
+// newMessageID returns a random identifier for a server-originated message
+func newMessageID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+// sendRaw queues a frame for writePump, giving up once the connection has closed
+func (c *Client) sendRaw(data []byte) {
+	select {
+	case c.send <- data:
+	case <-c.done:
+	}
 }
 
 func getHostname() string {
@@ -27,6 +27,13 @@ func corsMiddleware(next http.Handler) http.Handler {
 }
 
 func main() {
+	// The backend starts cells and shell commands through itself to apply resource limits
+	if len(os.Args) > 1 && os.Args[1] == api.LauncherArg {
+		err := api.Launch(os.Args[2:])
+		fmt.Fprintf(os.Stderr, "pysync launcher: %v\n", err)
+		os.Exit(127)
+	}
+
 	// Set up file logging
 	logFile, err := os.OpenFile("server.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 	if err != nil {
@@ -43,6 +50,8 @@ func main() {
 	mux.HandleFunc("/ws/aiSocket", logMiddleware(api.WebSocketChatGPT))
 	mux.HandleFunc("/ws/deploySocket", logMiddleware(api.DeployHandler))
 	mux.HandleFunc("/ws/testSocket", logMiddleware(api.WebSocketTestHandler)) // New WebSocket test endpoint
+	mux.HandleFunc("/output/", logMiddleware(api.OutputHandler))
+	mux.HandleFunc("/ws/debugSocket/", logMiddleware(api.DebugHandler))
 
 	// Wrap the mux with the CORS middleware
 	handler := corsMiddleware(mux)
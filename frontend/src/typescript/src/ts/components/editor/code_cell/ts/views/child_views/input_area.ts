@@ -3,6 +3,7 @@
 import { EditorState, Extension } from "@codemirror/state"
 import { EditorView, keymap, ViewUpdate, lineNumbers } from "@codemirror/view"
 import { defaultKeymap, indentWithTab } from "@codemirror/commands"
+import { autocompletion, CompletionContext, CompletionResult } from "@codemirror/autocomplete"
 import { python } from "@codemirror/lang-python"
 import { oneDark } from "@codemirror/theme-one-dark"
 import { syntaxHighlighting, defaultHighlightStyle, HighlightStyle, indentUnit} from "@codemirror/language"
@@ -117,6 +118,7 @@ export class InputArea {
                     extensions: [
                         keymap.of([...defaultKeymap, indentWithTab]),
                         python(),
+                        autocompletion({ override: [this.kernelCompletions] }),
                         syntaxHighlighting(defaultHighlightStyle),
                         syntaxHighlighting(myHighlightStyle),
                         lineNumbers(),
@@ -152,7 +154,7 @@ export class InputArea {
                 key: "Shift-Enter",
                 run: () => {
                     if (this.socket) {
-                        this.socket.send(this.exportCode());
+                        this.socket.send(this.executeRequest());
                         console.log("Sending", this.exportCode());
                     } else {
                         console.error("WebSocket is not available");
@@ -163,6 +165,63 @@ export class InputArea {
         ]);
     }
 
+    // Completions come from the kernel's live namespace, so `df.` offers what df really has
+    private kernelCompletions = (context: CompletionContext): Promise<CompletionResult | null> | null => {
+        const word = context.matchBefore(/[\w.]+/);
+        if (!context.explicit && !word) {
+            return null;
+        }
+        const code = context.state.doc.toString();
+        // The kernel counts characters in code points, CodeMirror in UTF-16 units
+        const codePoints = Array.from(code);
+        const toOffset = (cursor: number) => codePoints.slice(0, cursor).join('').length;
+        const cursor = Array.from(code.slice(0, context.pos)).length;
+        return this.request('complete_request', { code, cursor_pos: cursor }).then((reply) => {
+            if (!reply || reply.status !== 'ok') {
+                return null;
+            }
+            const completion = JSON.parse(reply.content);
+            return {
+                from: toOffset(completion.cursor_start),
+                to: toOffset(completion.cursor_end),
+                options: completion.matches.map((label: string) => ({ label })),
+            };
+        });
+    };
+
+    // Sends a request whose content is JSON and resolves with the server's reply to it, or
+    // with null if there is no connection or no reply within five seconds
+    private request(type: string, content: object): Promise<any | null> {
+        const socket = this.socket;
+        if (!socket || socket.readyState !== WebSocket.OPEN) {
+            return Promise.resolve(null);
+        }
+        const msgId = `${type}-${Date.now()}-${Math.random().toString(36).slice(2)}`;
+        return new Promise((resolve) => {
+            const onMessage = (event: MessageEvent) => {
+                if (typeof event.data !== 'string' || event.data === 'pong') {
+                    return;
+                }
+                try {
+                    const data = JSON.parse(event.data);
+                    if (data.parent_id === msgId) {
+                        finish(data);
+                    }
+                } catch (error) {
+                    // Not a JSON message, so not the reply
+                }
+            };
+            const timer = window.setTimeout(() => finish(null), 5000);
+            const finish = (data: any) => {
+                window.clearTimeout(timer);
+                socket.removeEventListener('message', onMessage);
+                resolve(data);
+            };
+            socket.addEventListener('message', onMessage);
+            socket.send(JSON.stringify({ type, msg_id: msgId, content: JSON.stringify(content) }));
+        });
+    }
+
     private updateContainerHeight() {
         if (this.editor) {
             const height = Math.max(this.editor.contentHeight, 70);
@@ -204,6 +263,17 @@ export class InputArea {
         });
     }
 
+    // Wraps the cell source in an execute request tagged with this cell's id, so that
+    // replies can be attached to the right output cell whatever order they arrive in
+    executeRequest(): string {
+        return JSON.stringify({
+            type: 'python',
+            msg_id: `${this.id}-${Date.now()}`,
+            cell_id: "code-cell-" + this.cc_id,
+            content: this.exportCode(),
+        });
+    }
+
     exportCode(): string {
         if (!this.editor) {
             console.error(`Cannot export code: Editor not initialized for InputArea ${this.id}`);
@@ -250,7 +320,7 @@ export class InputArea {
             e.preventDefault();
             e.stopPropagation();
             if (this.socket) {
-                this.socket.send(this.exportCode());
+                this.socket.send(this.executeRequest());
                 console.log("Sending", this.exportCode());
             } else {
                 console.error("WebSocket is not available");
@@ -0,0 +1,98 @@
+import { DOM } from "./../../../utility/dom";
+import { DarkMode } from './../../../themes/darkmode/darkmode';
+
+// An input field under a code cell whose code is reading stdin, with input() or getpass(). It
+// sits below the cell's output and goes away once it is answered or the cell ends.
+class InputPrompt {
+    id: string;
+    name: string;
+    code_cell_id: string;
+    div: HTMLElement;
+    input: HTMLInputElement;
+
+    constructor(code_cell_id: string, prompt: string, password: boolean, onSubmit: (value: string) => void)
+    {
+        this.name = "input-prompt";
+        this.code_cell_id = code_cell_id;
+        this.id = InputPrompt.idFor(code_cell_id);
+
+        this.div = this.createInputPromptDiv(prompt);
+        this.input = this.createInput(password);
+        this.div.appendChild(this.input);
+
+        this.input.addEventListener("keydown", (event: KeyboardEvent) => {
+            if (event.key === "Enter") {
+                event.preventDefault();
+                const value = this.input.value;
+                InputPrompt.remove(this.code_cell_id);
+                onSubmit(value);
+            }
+        });
+
+        this.addInputPrompt();
+        this.input.focus();
+    }
+
+    static idFor(code_cell_id: string): string {
+        return code_cell_id + "-input-prompt";
+    }
+
+    static remove(code_cell_id: string) {
+        DOM.removeElement(InputPrompt.idFor(code_cell_id));
+    }
+
+    createInputPromptDiv(prompt: string) {
+        let input_prompt = document.createElement("div");
+        input_prompt.setAttribute("id", this.id);
+        input_prompt.setAttribute("class", this.name);
+
+        input_prompt.style.display = "flex";
+        input_prompt.style.alignItems = "center";
+        input_prompt.style.gap = "8px";
+        input_prompt.style.boxSizing = "border-box";
+        input_prompt.style.marginLeft = "1vw";
+        input_prompt.style.marginBottom = "10px";
+        input_prompt.style.padding = "5px";
+        input_prompt.style.fontSize = "14px";
+        input_prompt.style.fontFamily = "monospace";
+
+        const label = document.createElement("span");
+        label.textContent = prompt;
+        label.style.whiteSpace = "pre";
+        input_prompt.appendChild(label);
+
+        return input_prompt;
+    }
+
+    createInput(password: boolean) {
+        const input = document.createElement("input");
+        // A password is masked and kept out of the browser's autofill
+        input.type = password ? "password" : "text";
+        input.autocomplete = password ? "new-password" : "off";
+        input.spellcheck = false;
+        input.style.flex = "1";
+        input.style.fontSize = "14px";
+        input.style.fontFamily = "monospace";
+        input.style.padding = "2px 5px";
+        input.style.boxSizing = "border-box";
+        input.style.border = "1px solid #888888";
+        input.style.borderRadius = "2px";
+        if (DarkMode.enabled) {
+            input.style.backgroundColor = "#111111";
+            input.style.color = "#ffffff";
+        } else {
+            input.style.backgroundColor = "#ffffff";
+            input.style.color = "#000000";
+        }
+        return input;
+    }
+
+    // Below the cell's output if it has any; output that comes later goes above the prompt
+    addInputPrompt() {
+        const output_cell_id = this.code_cell_id + "-output-cell";
+        const reference = document.getElementById(output_cell_id) ? output_cell_id : this.code_cell_id;
+        DOM.replaceElseAddAfter(this.div, reference);
+    }
+}
+
+export { InputPrompt };
@@ -1,6 +1,9 @@
 import { DOM } from "./../../../utility/dom";
 import { DarkMode } from './../../../themes/darkmode/darkmode';
 
+// One piece of a cell's output: text, or a base64 PNG such as a matplotlib figure
+type OutputPart = { type: 'text' | 'matplotlib'; content: string };
+
 class OutputCell {
     id: string;
     name: string;
@@ -8,7 +11,9 @@ class OutputCell {
     div: HTMLElement;
     code_cell_id: string;
 
-    constructor(code_cell_id: string, content: string, type: 'text' | 'matplotlib') 
+    // The content is either one piece of output of the given type, or every piece of a cell's
+    // output in order
+    constructor(code_cell_id: string, content: string | OutputPart[], type: 'text' | 'matplotlib' = 'text') 
     {
         this.name = "output-cell";
         this.code_cell_id = code_cell_id;
@@ -16,11 +21,15 @@ class OutputCell {
         this.input_area_id = code_cell_id + "-input-area";
 
         this.div = this.createOutputCellDiv();
-        if (type === 'text') {
-            this.renderText(content);
-        } else {
-            this.renderMatplotlibFigure(content);
+        const parts: OutputPart[] = typeof content === 'string' ? [{ type, content }] : content;
+        for (const part of parts) {
+            if (part.type === 'text') {
+                this.appendText(part.content);
+            } else {
+                this.appendMatplotlibFigure(part.content);
+            }
         }
+        this.adjustHeight(parts.some(part => part.type === 'matplotlib') ? 600 : 300); // Figures get more room
         this.addOutputCell();
     }
 
@@ -73,8 +82,16 @@ class OutputCell {
     }
 
     renderText(content: string) {
-        const maxHeight = 300;
-    
+        this.appendText(content);
+        this.adjustHeight(300);
+    }
+
+    renderMatplotlibFigure(base64Image: string) {
+        this.appendMatplotlibFigure(base64Image);
+        this.adjustHeight(600); // Increased max height for figures
+    }
+
+    private appendText(content: string) {
         const contentWrapper = document.createElement('div');
         contentWrapper.style.padding = "5px 0"; // Added vertical padding to content wrapper
     
@@ -88,10 +105,9 @@ class OutputCell {
         });
 
         this.div.appendChild(contentWrapper);
-        this.adjustHeight(maxHeight);
     }
 
-    renderMatplotlibFigure(base64Image: string) {
+    private appendMatplotlibFigure(base64Image: string) {
         const img = document.createElement('img');
         img.src = `data:image/png;base64,${base64Image}`;
         img.style.maxWidth = '100%';
@@ -99,8 +115,6 @@ class OutputCell {
         img.style.display = 'block';
         img.style.margin = '10px auto';
         this.div.appendChild(img);
-
-        this.adjustHeight(600); // Increased max height for figures
     }
 
     adjustHeight(maxHeight: number) {
@@ -120,4 +134,4 @@ class OutputCell {
     }
 }
 
-export { OutputCell };
\ No newline at end of file
+export { OutputCell, OutputPart };
\ No newline at end of file
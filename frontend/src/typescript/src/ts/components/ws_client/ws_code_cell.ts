@@ -1,5 +1,6 @@
 import { ObjectManager } from "../../managers/object_manager";
-import { OutputCell } from "../editor/output_cell/output_cell";
+import { OutputCell, OutputPart } from "../editor/output_cell/output_cell";
+import { InputPrompt } from "../editor/input_prompt/input_prompt";
 import { Terminal } from "./../../windows/terminal";
 
 class WebSocketCodeCell {
@@ -12,8 +13,9 @@ class WebSocketCodeCell {
     private pingInterval: number | null;
     private lastPongTime: number;
     private terminal: Terminal;
-    private executionQueue: { type: 'python' | 'shell' | 'env_info'; content: string }[] = [];
-    private isExecuting: boolean = false;
+    // Messages written while the socket is not open; the server queues executions itself
+    private pendingMessages: string[] = [];
+    private pythonOutputs: Map<string, OutputPart[]> = new Map();
 
     constructor(url: string, socketId: string, onOpenCallback: (socket: WebSocket) => void) {
         this.url = url;
@@ -52,7 +54,7 @@ class WebSocketCodeCell {
             this.onOpenCallback(this.socket);
         }
         this.startPingInterval();
-        this.processQueue();
+        this.flushPendingMessages();
     }
 
     private onMessage(event: MessageEvent): void {
@@ -63,29 +65,135 @@ class WebSocketCodeCell {
         } else {
             try {
                 const data = JSON.parse(event.data);
-                if (data.type === 'python_output') {
-                    console.log('Python executed output:\n', data.content);
+                if (data.type === 'python_stream') {
+                    this.appendPythonOutput(data, data.content);
+                } else if (data.type === 'display_data') {
+                    this.showDisplayData(data);
+                } else if (data.type === 'input_request') {
+                    this.answerInputRequest(data);
+                } else if (data.type === 'python_done') {
+                    console.log('Python execution finished:', data.status);
+                    // A cell interrupted while it waited for input no longer needs it
+                    const code_cell_id = this.codeCellId(data);
+                    if (code_cell_id) {
+                        InputPrompt.remove(code_cell_id);
+                    }
+                    if (data.content) {
+                        this.appendPythonOutput(data, data.content);
+                    }
+                    this.pythonOutputs.delete(data.parent_id || '');
+                } else if (data.type === 'shell_stream') {
+                    this.terminal.write(data.content);
+                } else if (data.type === 'shell_done') {
+                    console.log('Shell command finished:', data.status);
                     if (data.content) {
-                const editor = this.objectManager.getObject('editor');
-                if (editor) {
-                    let code_cell_id = "code-cell-" + editor.active_cell_number;
-                            new OutputCell(code_cell_id, data.content, "text");
-                        } else {
-                            console.warn('Editor not found or displayOutputCell is not a function');
-                            }
+                        this.terminal.write(data.content);
                     }
-                } else if (data.type === 'shell_output') {
-                            console.log('Shell command output:\n', data.content);
-                            this.terminal.write(data.content);
+                } else if (data.type === 'python_profile') {
+                    this.showProfile(data);
+                } else if (data.type === 'output_truncated') {
+                    this.showTruncatedOutput(data);
+                } else if (data.type === 'kernel_status') {
+                    console.log(`Kernel is ${data.status}${data.content ? ': ' + data.content : ''}`);
+                } else if (data.type === 'kernel_died') {
+                    console.warn(`Kernel died (${data.status}): ${data.content}`);
+                } else if (data.type === 'execution_status') {
+                    console.log(`Execution ${data.parent_id} is ${data.status}`);
                 }
             } catch (error) {
                 console.error('Error parsing message:', error);
             }
-            this.isExecuting = false;
-            this.processQueue();
         }
     }
 
+    // Output is accumulated per request and rendered into the cell the request came from;
+    // requests without a cell_id fall back to the active cell
+    private appendPythonOutput(data: { parent_id?: string; cell_id?: string }, content: string, type: 'text' | 'matplotlib' = 'text'): void {
+        const key = data.parent_id || '';
+        const output = this.pythonOutputs.get(key) || [];
+        const last = output[output.length - 1];
+        if (type === 'text' && last?.type === 'text') {
+            last.content += content;
+        } else {
+            output.push({ type, content });
+        }
+        this.pythonOutputs.set(key, output);
+
+        const code_cell_id = this.codeCellId(data);
+        if (code_cell_id) {
+            new OutputCell(code_cell_id, output);
+        }
+    }
+
+    // The cell a message belongs to: its cell_id, or else the active cell
+    private codeCellId(data: { cell_id?: string }): string | null {
+        if (data.cell_id) {
+            return data.cell_id;
+        }
+        const editor = this.objectManager.getObject('editor');
+        if (!editor) {
+            console.warn('Editor not found or displayOutputCell is not a function');
+            return null;
+        }
+        return "code-cell-" + editor.active_cell_number;
+    }
+
+    // Images go after the cell's earlier output; other bundles fall back to their plain text form
+    private showDisplayData(data: { parent_id?: string; cell_id?: string; data?: { [mime: string]: any } }): void {
+        const bundle = data.data || {};
+        if (typeof bundle['image/png'] === 'string') {
+            this.appendPythonOutput(data, bundle['image/png'], 'matplotlib');
+        } else if (typeof bundle['text/plain'] === 'string') {
+            this.appendPythonOutput(data, bundle['text/plain'] + '\n');
+        }
+    }
+
+    // Output past the server's limit is not sent; the server sends its end and a link to all of it
+    private showTruncatedOutput(data: { parent_id?: string; cell_id?: string; content: string; url?: string; omitted: number }): void {
+        const link = data.url ? ` Full output: ${new URL(data.url, this.url.replace(/^ws/, 'http')).href}` : '';
+        const notice = `\n[... ${data.omitted} bytes of output omitted.${link}]\n`;
+        if (this.pythonOutputs.has(data.parent_id || '')) {
+            this.appendPythonOutput(data, notice + data.content);
+        } else {
+            this.terminal.write(notice + data.content);
+        }
+    }
+
+    // A profiled cell's report is shown below its output as a plain text table
+    private showProfile(data: { parent_id?: string; cell_id?: string; content: string }): void {
+        const report = JSON.parse(data.content);
+        const seconds = (value: number) => value.toFixed(4).padStart(10);
+        const lines = [`\nProfile: ${report.total_calls} calls in ${report.total_time.toFixed(4)} s`, '     calls    tottime    cumtime  function'];
+        for (const f of report.functions) {
+            const where = f.filename ? ` (${f.filename}:${f.lineno})` : '';
+            lines.push(`${String(f.calls).padStart(10)} ${seconds(f.total_time)} ${seconds(f.cumulative_time)}  ${f.function}${where}`);
+        }
+        if (report.memory) {
+            lines.push(`\nMemory: peak ${report.memory.peak} bytes, ${report.memory.allocated} bytes still allocated`);
+            for (const site of report.memory.sites) {
+                lines.push(`${String(site.size).padStart(10)} bytes in ${site.count} blocks  ${site.filename}:${site.lineno}  ${site.line}`);
+            }
+        }
+        this.appendPythonOutput(data, lines.join('\n') + '\n');
+    }
+
+    // input() and getpass() in a cell block until the server gets an input_reply. The answer is
+    // typed into a field under the cell, masked for a password, and echoed to the cell's output
+    // unless it is a password.
+    private answerInputRequest(data: { msg_id: string; parent_id?: string; cell_id?: string; content: string; password?: boolean }): void {
+        const code_cell_id = this.codeCellId(data);
+        if (!code_cell_id) {
+            return;
+        }
+        const prompt = data.content || (data.password ? 'Password:' : '');
+        new InputPrompt(code_cell_id, prompt, !!data.password, (value: string) => {
+            this.appendPythonOutput(data, `${prompt}${data.password ? '' : value}\n`);
+            if (this.socket && this.socket.readyState === WebSocket.OPEN) {
+                this.socket.send(JSON.stringify({ type: 'input_reply', parent_id: data.msg_id, content: value }));
+            }
+        });
+    }
+
     private onError(event: Event): void {
         console.error('CodeCell WebSocket error:', event);
     }
@@ -152,25 +260,19 @@ class WebSocketCodeCell {
             // For other types, use JSON format
             message = JSON.stringify({ type, content });
         }
-        this.executionQueue.push({ type, content: message });
-        this.processQueue();
+        this.pendingMessages.push(message);
+        this.flushPendingMessages();
     }
 
-    private processQueue(): void {
-        if (this.isExecuting || this.executionQueue.length === 0) {
+    private flushPendingMessages(): void {
+        if (!this.socket || this.socket.readyState !== WebSocket.OPEN) {
+            console.warn('WebSocket is not open. Message will be sent once it is.');
             return;
         }
-
-        this.isExecuting = true;
-        const { content } = this.executionQueue.shift()!;
-
-        if (this.socket && this.socket.readyState === WebSocket.OPEN) {
-            this.socket.send(content);
-            console.log('Sent message:', content);
-        } else {
-            console.warn('WebSocket is not open. Cannot send message.');
-            this.isExecuting = false;
-            this.processQueue();
+        while (this.pendingMessages.length > 0) {
+            const message = this.pendingMessages.shift()!;
+            this.socket.send(message);
+            console.log('Sent message:', message);
         }
     }
 